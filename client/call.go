@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flera/protocol"
+	"fmt"
+)
+
+// CallHandler handles a call from the server, what it returns is sent back
+// as the reply. An error reaches the caller as a *protocol.RemoteError.
+type CallHandler func(c *Client, data []byte) ([]byte, error)
+
+// RegisterCall registers a handler that answers calls from the server.
+// Handlers registered with Register can also be called, they reply with no
+// data or their error.
+func (c *Client) RegisterCall(id uint32, handler CallHandler) {
+	if protocol.IsReserved(id) {
+		panic(fmt.Sprintf("flera: handler id %d is reserved", id))
+	}
+	c.callHandlers[id] = handler
+}
+
+// Call runs handlerId on the server over the safe channel and waits for its
+// reply, until ctx is done. An error returned by the handler comes back as
+// a *protocol.RemoteError.
+//
+// Handlers run on the goroutine reading from the server, so a handler that
+// makes a call blocks until ctx is done.
+func (c *Client) Call(ctx context.Context, handlerId uint32, data []byte) ([]byte, error) {
+	sess := c.sess.Load()
+	if sess == nil {
+		return nil, errNotConnected
+	}
+
+	return sess.calls.Do(ctx, handlerId, data, func(call []byte) error {
+		return c.sendSafe(sess, protocol.HandlerCall, call)
+	})
+}
+
+// handleCall answers calls from the server and hands replies to the calls
+// waiting for them. It reports whether the frame was one of them.
+func (c *Client) handleCall(sess *session, handlerId uint32, data []byte) (bool, error) {
+	switch handlerId {
+	case protocol.HandlerCall:
+		var call protocol.Call
+		if err := call.Unmarshal(data); err != nil {
+			return true, err
+		}
+
+		var reply []byte
+		var err error
+		if handler, ok := c.callHandlers[call.HandlerId]; ok {
+			// middleware only sees the error, the reply is kept here
+			fn := func(c *Client, data []byte) error {
+				var err error
+				reply, err = handler(c, data)
+				return err
+			}
+			err = c.invoke(call.HandlerId, fn, call.Data)
+		} else if handler, ok := c.handlers[call.HandlerId]; ok {
+			err = c.invoke(call.HandlerId, handler, call.Data)
+		} else {
+			err = fmt.Errorf("no handler with id %d", call.HandlerId)
+		}
+
+		r := protocol.NewReply(call, reply, err).Fit(c.MaxMessageSize)
+		if err := c.sendSafe(sess, protocol.HandlerReply, r.Marshal()); err != nil {
+			c.logger().Warn("sending reply failed", "connId", sess.id, "handlerId", call.HandlerId, "err", err)
+		}
+
+		// the caller gets the error, only panics are reported here
+		var panicErr *protocol.PanicError
+		if errors.As(err, &panicErr) {
+			c.fail(sess, call.HandlerId, err)
+		}
+		return true, nil
+	case protocol.HandlerReply:
+		var reply protocol.Reply
+		if err := reply.Unmarshal(data); err != nil {
+			return true, err
+		}
+		sess.calls.Finish(reply)
+		return true, nil
+	}
+	return false, nil
+}
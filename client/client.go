@@ -1,61 +1,208 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
+	"flera/codec"
+	"flera/protocol"
 	"fmt"
-	"net"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var errNotConnected = errors.New("not connected")
+
+// discard is the Logger of a new client.
+var discard = slog.New(slog.DiscardHandler)
+
 type Client struct {
-	Id            uint32
-	handlers      map[uint32]Handler
-	tcpServer     *net.TCPConn
-	udpServer     *net.UDPConn
-	tcpConnected  bool
-	udpConnected  bool
+	handlers     map[uint32]Handler
+	callHandlers map[uint32]CallHandler
+	// middleware wraps every handler, handlerMiddleware only the handler
+	// of one id
+	middleware        []Middleware
+	handlerMiddleware map[uint32][]Middleware
+	// addr is the server address given to Connect, reconnects dial it again
+	addr string
+	// sess is the current connection to the server
+	sess atomic.Pointer[session]
+	// mu orders starting sessions and reconnects against Disconnect
+	mu sync.Mutex
+	// wg tracks reconnects
+	wg sync.WaitGroup
+	// UdpPacketSize is the largest payload put in a single datagram, bigger
+	// fast messages are split into fragments. It has to match the server.
+	// Once the path MTU is discovered the packet size of the connection is
+	// set from it instead.
 	UdpPacketSize uint32
+	// MaxMessageSize caps the size of a single message. The connection is
+	// dropped if the server announces a bigger safe (tcp) message, bigger
+	// fast ones are dropped.
+	MaxMessageSize uint32
+	// TLSConfig turns on encryption, it must match the server. The safe
+	// channel runs over tls and the fast channel is encrypted with keys
+	// exported from it.
+	TLSConfig *tls.Config
+	// OnError is called when a handler returned an error or panicked, the
+	// error of a panic is a *protocol.PanicError. Errors of call handlers
+	// are sent back to the server instead, only their panics end up here.
+	OnError ErrorHandler
+	// ErrorPolicy decides what happens to the connection after OnError,
+	// logging the error by default.
+	ErrorPolicy protocol.ErrorPolicy
+	// Logger receives what happens on the connection, nothing is logged by
+	// default or when it is nil.
+	Logger *slog.Logger
+	// Codec encodes the messages of the typed helpers like Handle and Send,
+	// it must match the server. JSON by default.
+	Codec codec.Codec
+	// HeartbeatInterval is how often the server is pinged, 0 turns pings
+	// off.
+	HeartbeatInterval time.Duration
+	// IdleTimeout is how long the server can stay silent before the
+	// connection is considered lost, 0 waits forever.
+	IdleTimeout time.Duration
+	// Credentials are sent to the server when connecting, for its
+	// Authenticate callback. Reconnects send them again.
+	Credentials []byte
+	// Reconnect turns on reconnecting after the connection is lost, nil
+	// leaves the client disconnected.
+	Reconnect *ReconnectPolicy
+	// OnDisconnect is called once when the connection to the server is lost
+	// for good, with Reconnect set only after giving up. reason tells why,
+	// the server sends it when it drops the client on purpose.
+	OnDisconnect func(c *Client, reason protocol.DisconnectReason)
+	// OnReconnect is called when a reconnect got a new connection, and so a
+	// new Id, OnResume when it resumed the session of the lost one.
+	OnReconnect func(c *Client)
+	OnResume    func(c *Client)
 }
 
+// Handler handles one message from the server. data is only valid until the
+// handler returns, as its memory is reused for later messages; copy it to
+// keep it around.
 type Handler func(c *Client, data []byte) error
 
 func (c *Client) Register(id uint32, handler Handler) {
+	if protocol.IsReserved(id) {
+		panic(fmt.Sprintf("flera: handler id %d is reserved", id))
+	}
 	c.handlers[id] = handler
 }
 
-func (c *Client) Connect(port string) error {
-
-	if err := c.connectTcp(port); err != nil {
+// Connect connects to the server at addr. A server turning the client away
+// makes it return a *RejectedError.
+func (c *Client) Connect(addr string) error {
+	tcpConn, err := c.connectTcp(addr)
+	if err != nil {
 		return err
 	}
-	// Grab id
-	idBuf := make([]byte, 4)
-	if _, err := c.tcpServer.Read(idBuf); err != nil {
+	sess, _, err := c.handshake(tcpConn, addr, nil)
+	if err != nil {
 		return err
 	}
-	if err := binary.Read(bytes.NewReader(idBuf), binary.BigEndian, &c.Id); err != nil {
-		return err
+	c.addr = addr
+	c.logger().Info("connected", "connId", sess.id, "addr", sess.tcp.RemoteAddr())
+	c.mu.Lock()
+	c.start(sess, make(chan struct{}))
+	c.mu.Unlock()
+	return nil
+}
+
+// Disconnect leaves the server and stops reconnecting, the server sees the
+// client left rather than lost its connection. The connection is torn down
+// in the background, OnDisconnect fires once it is. Unlike Close it can be
+// called from handlers.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	sess := c.sess.Load()
+	if sess == nil || closed(sess.quit) {
+		c.mu.Unlock()
+		return errNotConnected
 	}
-	fmt.Println(c.Id)
-	go c.handleTcpConn()
+	close(sess.quit)
+	c.mu.Unlock()
 
-	if err := c.connectUdp(port); err != nil {
-		return err
+	c.logger().Info("leaving", "connId", sess.id)
+	return c.leave(sess, protocol.DisconnectReason{Code: protocol.ClientQuit})
+}
+
+// Close disconnects like Disconnect and waits until every goroutine of the
+// client stopped, a later Connect starts over. It must not be called from a
+// handler, as handlers run on those goroutines.
+func (c *Client) Close() error {
+	err := c.Disconnect()
+	c.wg.Wait()
+	if sess := c.sess.Load(); sess != nil {
+		sess.wg.Wait()
 	}
-	go c.handleUdpConn()
+	if errors.Is(err, errNotConnected) {
+		return nil
+	}
+	return err
+}
 
-	return nil
+// Id is the connection id the server gave us, it changes when a reconnect
+// gets a new connection. It is 0 before the client connected.
+func (c *Client) Id() uint32 {
+	sess := c.sess.Load()
+	if sess == nil {
+		return 0
+	}
+	return sess.id
+}
+
+// Send sends data to handlerId on the server over the given channel.
+func (c *Client) Send(ch protocol.Channel, handlerId uint32, data []byte) error {
+	sess := c.sess.Load()
+	if sess == nil {
+		return errNotConnected
+	}
+	return c.send(sess, ch, handlerId, data)
+}
+
+func (c *Client) send(sess *session, ch protocol.Channel, handlerId uint32, data []byte) error {
+	if ch == protocol.Safe {
+		return c.sendSafe(sess, handlerId, data)
+	}
+	return sess.link.Send(ch, handlerId, data)
+}
+
+// Stats returns the link quality and traffic of the connection to the
+// server.
+func (c *Client) Stats() protocol.Stats {
+	sess := c.sess.Load()
+	if sess == nil {
+		return protocol.Stats{}
+	}
+	return sess.link.Stats()
 }
 
 func (c *Client) Connected() bool {
-	return c.tcpConnected && c.udpConnected
+	sess := c.sess.Load()
+	return sess != nil && sess.tcpConnected.Load() && sess.udpConnected.Load()
 }
 
 func New() *Client {
 	c := new(Client)
 	c.handlers = make(map[uint32]Handler)
-	c.tcpConnected = false
-	c.udpConnected = false
-	c.UdpPacketSize = 1024
+	c.callHandlers = make(map[uint32]CallHandler)
+	c.handlerMiddleware = make(map[uint32][]Middleware)
+	c.UdpPacketSize = protocol.DefaultPacketSize
+	c.MaxMessageSize = protocol.DefaultMaxMessageSize
+	c.HeartbeatInterval = protocol.DefaultHeartbeatInterval
+	c.IdleTimeout = protocol.DefaultIdleTimeout
+	c.Codec = codec.JSON
+	c.Logger = discard
 	return c
 }
+
+// logger returns Logger, or one that drops everything when it is nil.
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return discard
+	}
+	return c.Logger
+}
@@ -0,0 +1,33 @@
+package client
+
+import "flera/protocol"
+
+// ErrorHandler is called when a handler returned an error or panicked.
+type ErrorHandler func(c *Client, handlerId uint32, err error)
+
+// invoke runs handler in its middleware, a panic is returned as a
+// *protocol.PanicError.
+func (c *Client) invoke(handlerId uint32, handler Handler, data []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = protocol.NewPanicError(v)
+		}
+	}()
+	return c.wrap(handlerId, handler)(c, data)
+}
+
+// fail reports the error of a handler to OnError and applies the
+// ErrorPolicy.
+func (c *Client) fail(sess *session, handlerId uint32, err error) {
+	if c.OnError != nil {
+		c.OnError(c, handlerId, err)
+	}
+
+	switch c.ErrorPolicy {
+	case protocol.LogErrors:
+		c.logger().Error("handler failed", "connId", sess.id, "handlerId", handlerId, "err", err)
+	case protocol.DisconnectOnError:
+		c.logger().Error("handler failed, disconnecting", "connId", sess.id, "handlerId", handlerId, "err", err)
+		c.leave(sess, protocol.DisconnectReason{Code: protocol.ClientQuit, Message: "handler failed"})
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"flera/protocol"
+	"time"
+)
+
+// heartbeat pings the server on both channels every HeartbeatInterval, which
+// keeps the idle timeout of the server from firing. As long as nothing comes
+// back over udp the hello is repeated, in case it got lost or the server
+// forgot our address.
+func (c *Client) heartbeat(sess *session) {
+	if c.HeartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.done:
+			return
+		}
+
+		if err := c.sendSafe(sess, protocol.HandlerPing, protocol.PingPayload()); err != nil {
+			c.logger().Debug("ping failed", "connId", sess.id, "channel", protocol.Safe, "err", err)
+		}
+
+		seen := time.Unix(0, sess.udpSeen.Load())
+		if time.Since(seen) > 2*c.HeartbeatInterval {
+			if err := sess.link.Send(protocol.Fast, protocol.HandlerHello, nil); err != nil {
+				c.logger().Debug("hello failed", "connId", sess.id, "err", err)
+			}
+		}
+		if err := sess.link.Send(protocol.Fast, protocol.HandlerPing, protocol.PingPayload()); err != nil {
+			c.logger().Debug("ping failed", "connId", sess.id, "channel", protocol.Fast, "err", err)
+		}
+	}
+}
+
+// handleControl answers the reserved messages of the heartbeat. It reports
+// whether the message was one of them.
+func (c *Client) handleControl(sess *session, handlerId uint32, data []byte, udp bool) bool {
+	switch handlerId {
+	case protocol.HandlerPing:
+		ch := protocol.Safe
+		if udp {
+			ch = protocol.Fast
+		}
+		if err := c.send(sess, ch, protocol.HandlerPong, data); err != nil {
+			c.logger().Debug("pong failed", "connId", sess.id, "channel", ch, "err", err)
+		}
+		return true
+	case protocol.HandlerPong:
+		if rtt, ok := protocol.PongRTT(data); ok {
+			sess.link.Meter().AddRTTSample(rtt)
+		}
+		return true
+	}
+	return false
+}
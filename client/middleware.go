@@ -0,0 +1,32 @@
+package client
+
+// Middleware wraps a handler, to run code around it or to not call it at
+// all.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware that wraps every handler. Like Register it has to be
+// called before connecting.
+//
+// Middleware added with Use runs before the one added with UseFor, and
+// within each scope in the order it was added: the first middleware is the
+// outermost.
+func (c *Client) Use(mw ...Middleware) {
+	c.middleware = append(c.middleware, mw...)
+}
+
+// UseFor adds middleware that only wraps the handler of handlerId.
+func (c *Client) UseFor(handlerId uint32, mw ...Middleware) {
+	c.handlerMiddleware[handlerId] = append(c.handlerMiddleware[handlerId], mw...)
+}
+
+// wrap puts the middleware for handlerId around h.
+func (c *Client) wrap(handlerId uint32, h Handler) Handler {
+	scoped := c.handlerMiddleware[handlerId]
+	for i := len(scoped) - 1; i >= 0; i-- {
+		h = scoped[i](h)
+	}
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		h = c.middleware[i](h)
+	}
+	return h
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flera/protocol"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeTimeout bounds how long the server may take to welcome us.
+const handshakeTimeout = 10 * time.Second
+
+// leaveTimeout bounds how long a leaving client waits for the server to
+// close the connection after the goodbye.
+const leaveTimeout = time.Second
+
+// ReconnectPolicy decides how a lost connection is reconnected. The delay
+// between attempts starts at Delay and doubles after every failed attempt,
+// up to MaxDelay.
+type ReconnectPolicy struct {
+	// MaxAttempts is how many times to try before giving up, 0 tries
+	// forever.
+	MaxAttempts int
+	Delay       time.Duration
+	// MaxDelay caps the delay, 0 lets it grow without bound.
+	MaxDelay time.Duration
+}
+
+// RejectedError is returned by Connect when the server turned the client
+// away, Reason tells why.
+type RejectedError struct {
+	Reason protocol.DisconnectReason
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by server: " + e.Reason.String()
+}
+
+// session is one connection to the server, a reconnect starts a new one.
+type session struct {
+	id           uint32
+	tcp          net.Conn
+	udp          *net.UDPConn
+	link         *protocol.Link
+	tcpConnected atomic.Bool
+	udpConnected atomic.Bool
+	// token resumes the session after the connection is lost, empty when
+	// the server doesn't keep sessions
+	token []byte
+	// calls made to the server that wait for their reply
+	calls *protocol.Calls
+	// quit is closed by Disconnect, it is handed on to the sessions of
+	// reconnects
+	quit chan struct{}
+	// reason is why the session ends, nil while it is up
+	reason   *protocol.DisconnectReason
+	reasonMu sync.Mutex
+	// done is closed once the connection is lost
+	done     chan struct{}
+	doneOnce sync.Once
+	// udpSeen is when the last datagram came in, as unix nanoseconds
+	udpSeen atomic.Int64
+	// wg tracks the goroutines serving the session
+	wg sync.WaitGroup
+}
+
+// stop records why the session ends, only the first reason sticks. It
+// returns the reason that stuck and whether it was this one.
+func (sess *session) stop(reason protocol.DisconnectReason) (protocol.DisconnectReason, bool) {
+	sess.reasonMu.Lock()
+	defer sess.reasonMu.Unlock()
+	if sess.reason != nil {
+		return *sess.reason, false
+	}
+	sess.reason = &reason
+	return reason, true
+}
+
+// stopping reports whether the session is ending on purpose or already
+// ended.
+func (sess *session) stopping() bool {
+	sess.reasonMu.Lock()
+	defer sess.reasonMu.Unlock()
+	return sess.reason != nil
+}
+
+// handshake opens a session on tcpConn, resuming the one of token when it
+// isn't empty and the server still has it.
+func (c *Client) handshake(tcpConn net.Conn, addr string, token []byte) (*session, protocol.Welcome, error) {
+	var welcome protocol.Welcome
+	tcpConn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	handshake := protocol.Handshake{Token: token, Credentials: c.Credentials}
+	if err := protocol.WriteFrame(tcpConn, protocol.HandlerHandshake, handshake.Marshal(), c.MaxMessageSize); err != nil {
+		tcpConn.Close()
+		return nil, welcome, err
+	}
+
+	// Grab id and the secret used to sign udp packets
+	handlerId, data, err := protocol.ReadFrame(tcpConn, c.MaxMessageSize)
+	if err != nil {
+		tcpConn.Close()
+		return nil, welcome, err
+	}
+	if handlerId == protocol.HandlerClose {
+		tcpConn.Close()
+		var reason protocol.DisconnectReason
+		if err := reason.Unmarshal(data); err != nil {
+			return nil, welcome, err
+		}
+		return nil, welcome, &RejectedError{Reason: reason}
+	}
+	if handlerId != protocol.HandlerWelcome {
+		tcpConn.Close()
+		return nil, welcome, &protocol.ProtocolError{Err: fmt.Errorf("expected welcome, got handler %d", handlerId)}
+	}
+	if err := welcome.Unmarshal(data); err != nil {
+		tcpConn.Close()
+		return nil, welcome, err
+	}
+	tcpConn.SetDeadline(time.Time{})
+
+	sess := &session{
+		id:    welcome.ConnId,
+		tcp:   tcpConn,
+		token: welcome.Token,
+		calls: new(protocol.Calls),
+		done:  make(chan struct{}),
+	}
+	if tlsConn, ok := tcpConn.(*tls.Conn); ok {
+		sess.link, err = protocol.NewTLSLink(sess.id, tlsConn.ConnectionState(), false)
+		if err != nil {
+			tcpConn.Close()
+			return nil, welcome, err
+		}
+	} else {
+		sess.link = protocol.NewLink(sess.id, welcome.Secret, false)
+	}
+	sess.link.SetWriter(func(packet []byte) error { return c.writeUdp(sess, packet) })
+	sess.link.SetPacketSize(int(c.UdpPacketSize))
+	sess.link.SetMaxMessageSize(c.MaxMessageSize)
+
+	if sess.udp, err = c.connectUdp(addr); err != nil {
+		tcpConn.Close()
+		return nil, welcome, err
+	}
+	return sess, welcome, nil
+}
+
+// start makes sess the current session and starts serving it, c.mu must
+// be held.
+func (c *Client) start(sess *session, quit chan struct{}) {
+	sess.quit = quit
+	sess.tcpConnected.Store(true)
+	sess.udpConnected.Store(true)
+	c.sess.Store(sess)
+
+	sess.wg.Add(4)
+	go func() {
+		defer sess.wg.Done()
+		c.handleTcpConn(sess)
+	}()
+	go func() {
+		defer sess.wg.Done()
+		c.handleUdpConn(sess)
+	}()
+	go func() {
+		defer sess.wg.Done()
+		c.heartbeat(sess)
+	}()
+	go func() {
+		defer sess.wg.Done()
+		sess.link.Run(sess.done)
+	}()
+}
+
+// lost tears sess down once one of the channels ended with reason, then
+// reconnects when worth it or fires OnDisconnect. Only the first call does
+// anything, and a reason given earlier to stop wins.
+func (c *Client) lost(sess *session, reason protocol.DisconnectReason) {
+	sess.doneOnce.Do(func() {
+		reason, _ := sess.stop(reason)
+		close(sess.done)
+		sess.calls.Abort()
+		sess.tcp.Close()
+		sess.udp.Close()
+
+		// checked under c.mu so Close either waits for the reconnect or
+		// Disconnect stops it from starting
+		c.mu.Lock()
+		reconnect := reason.Retry() && c.Reconnect != nil && !closed(sess.quit)
+		if reconnect {
+			c.wg.Add(1)
+		}
+		c.mu.Unlock()
+
+		if reconnect {
+			go c.reconnect(sess, reason)
+		} else {
+			c.disconnected(sess, reason)
+		}
+	})
+}
+
+// leave closes sess on purpose, telling the server why, and waits for the
+// server to close the connection so the close frame isn't lost to a reset.
+func (c *Client) leave(sess *session, reason protocol.DisconnectReason) error {
+	if _, first := sess.stop(reason); !first {
+		return nil
+	}
+
+	err := c.sendSafe(sess, protocol.HandlerClose, reason.Marshal())
+	if tcpConn, ok := sess.tcp.(interface{ CloseWrite() error }); ok && err == nil {
+		tcpConn.CloseWrite()
+		sess.tcp.SetReadDeadline(time.Now().Add(leaveTimeout))
+		return nil
+	}
+	c.lost(sess, reason)
+	return err
+}
+
+func (c *Client) disconnected(sess *session, reason protocol.DisconnectReason) {
+	c.logger().Info("disconnected", "connId", sess.id, "reason", reason)
+	if c.OnDisconnect != nil {
+		c.OnDisconnect(c, reason)
+	}
+}
+
+// reconnect dials the server again until it gets a new session or the
+// policy gives up, resuming the session of old if the server kept it.
+func (c *Client) reconnect(old *session, reason protocol.DisconnectReason) {
+	defer c.wg.Done()
+	// handlers of the old session must not overlap the new one
+	old.wg.Wait()
+
+	// dialing and the handshake give up once Disconnect is called
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-old.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	policy := *c.Reconnect
+	delay := policy.Delay
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-old.quit:
+			timer.Stop()
+			c.stopReconnecting(old)
+			return
+		}
+		if delay *= 2; policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+
+		c.logger().Info("reconnecting", "connId", old.id, "attempt", attempt)
+		tcpConn, err := c.dialTcp(ctx, c.addr)
+		if err != nil {
+			c.logger().Warn("reconnect failed", "connId", old.id, "attempt", attempt, "err", err)
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { tcpConn.SetDeadline(time.Now()) })
+		sess, welcome, err := c.handshake(tcpConn, c.addr, old.token)
+		stop()
+		var rejected *RejectedError
+		if errors.As(err, &rejected) && !rejected.Reason.Retry() {
+			c.logger().Warn("reconnect rejected", "connId", old.id, "reason", rejected.Reason)
+			c.disconnected(old, rejected.Reason)
+			return
+		}
+		if err != nil {
+			c.logger().Warn("reconnect failed", "connId", old.id, "attempt", attempt, "err", err)
+			continue
+		}
+
+		c.mu.Lock()
+		if closed(old.quit) {
+			c.mu.Unlock()
+			sess.tcp.Close()
+			sess.udp.Close()
+			c.stopReconnecting(old)
+			return
+		}
+		c.start(sess, old.quit)
+		c.mu.Unlock()
+
+		if welcome.Resumed {
+			c.logger().Info("resumed", "connId", sess.id, "addr", sess.tcp.RemoteAddr())
+			if c.OnResume != nil {
+				c.OnResume(c)
+			}
+		} else {
+			c.logger().Info("reconnected", "connId", sess.id, "addr", sess.tcp.RemoteAddr())
+			if c.OnReconnect != nil {
+				c.OnReconnect(c)
+			}
+		}
+		return
+	}
+
+	c.logger().Warn("giving up reconnecting", "connId", old.id)
+	c.disconnected(old, reason)
+}
+
+func (c *Client) stopReconnecting(old *session) {
+	c.logger().Info("stopped reconnecting", "connId", old.id)
+	c.disconnected(old, protocol.DisconnectReason{Code: protocol.ClientQuit})
+}
+
+func closed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,99 +1,142 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flera/protocol"
+	"io"
 	"net"
 	"time"
 )
 
-func (c *Client) connectTcp(port string) error {
-	addr, err := net.ResolveTCPAddr("tcp", port)
-	if err != nil {
-		return err
-	}
-
+// connectTcp dials the server, retrying a few times if it isn't up yet.
+func (c *Client) connectTcp(addr string) (net.Conn, error) {
 	attempts := 0
 	for {
-		c.tcpServer, err = net.DialTCP("tcp", nil, addr)
+		conn, err := c.dialTcp(context.Background(), addr)
 		if err != nil {
-			fmt.Println("Failed to connect to tcp, will try again in 5 secs")
+			var netErr *net.OpError
+			if !errors.As(err, &netErr) || netErr.Op != "dial" {
+				return nil, err
+			}
+			c.logger().Warn("tcp connect failed, retrying in 5s", "addr", addr, "err", err)
 			if 5 == attempts {
-				return err
+				return nil, err
 			}
 			attempts++
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		return nil
+		return conn, nil
+	}
+}
+
+// dialTcp connects to the server and does the tls handshake if needed,
+// giving up after handshakeTimeout or once ctx is done.
+func (c *Client) dialTcp(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLSConfig == nil {
+		return conn, nil
+	}
+
+	config := c.TLSConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		// verify the server against the host we dialed, like tls.Dial
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return tlsConn, nil
 }
 
-func (c *Client) handleTcpConn() {
-	c.tcpConnected = true
+func (c *Client) handleTcpConn(sess *session) {
+	reason := protocol.DisconnectReason{Code: protocol.ConnectionLost}
 	defer func() {
-		c.tcpConnected = false
-		fmt.Println("tcp lost")
+		sess.tcpConnected.Store(false)
+		c.logger().Info("tcp lost", "connId", sess.id)
+		c.lost(sess, reason)
 	}()
 
 	// listen for messages
-	info := make([]byte, 8)
 	for {
-		// fmt.Println("Waiting on tcp")
+		// a leaving client waits leaveTimeout instead
+		if c.IdleTimeout > 0 && !sess.stopping() {
+			sess.tcp.SetReadDeadline(time.Now().Add(c.IdleTimeout))
+		}
 
-		// First read the info part of the packet
-		if _, err := c.tcpServer.Read(info); err != nil {
-			fmt.Println(err)
+		handlerId, data, err := protocol.ReadFrame(sess.tcp, c.MaxMessageSize)
+		if err != nil {
+			reason = protocol.ReadReason(err)
+			switch {
+			case sess.stopping():
+				// left, the server closed the connection
+			case reason.Code == protocol.TimedOut:
+				c.logger().Info("server timed out", "connId", sess.id)
+			case !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+				c.logger().Warn("tcp read failed", "connId", sess.id, "err", err)
+			}
 			return
 		}
-		// fmt.Println("Got something on tcp")
 
-		var handlerId uint32
-		if err := binary.Read(bytes.NewReader(info[:4]), binary.BigEndian, &handlerId); err != nil {
-			fmt.Println(err)
-			continue
-		}
+		sess.link.Meter().ReceivedSafe(len(data))
 
-		var size uint32
-		if err := binary.Read(bytes.NewReader(info[4:]), binary.BigEndian, &size); err != nil {
-			fmt.Println(err)
+		if handlerId == protocol.HandlerClose {
+			if err := reason.Unmarshal(data); err != nil {
+				reason = protocol.ReadReason(err)
+			}
+			c.logger().Info("closed by server", "connId", sess.id, "reason", reason)
+			return
+		}
+		if c.handleControl(sess, handlerId, data, false) {
 			continue
 		}
 
-		// Read data
-		data := make([]byte, size)
-		if _, err := c.tcpServer.Read(data); err != nil {
-			fmt.Println(err)
+		if handled, err := c.handleCall(sess, handlerId, data); err != nil {
+			c.logger().Warn("bad call", "connId", sess.id, "handlerId", handlerId, "err", err)
+			reason = protocol.ReadReason(err)
+			return
+		} else if handled {
 			continue
 		}
 
 		if handler, ok := c.handlers[handlerId]; ok {
-			handler(c, data)
+			if err := c.invoke(handlerId, handler, data); err != nil {
+				c.fail(sess, handlerId, err)
+			}
 		} else {
-			fmt.Printf("No handler with id %d from tcp\n", handlerId)
+			c.logger().Debug("no handler", "connId", sess.id, "handlerId", handlerId, "channel", protocol.Safe)
 			continue
 		}
 	}
 }
 
 func (c *Client) SendSafe(handlerId uint32, data []byte) error {
-	handlerBuf := new(bytes.Buffer)
-	if err := binary.Write(handlerBuf, binary.BigEndian, uint32(handlerId)); err != nil {
-		return err
-	}
-
-	sizeBuf := new(bytes.Buffer)
-	if err := binary.Write(sizeBuf, binary.BigEndian, uint32(len(data))); err != nil {
-		return err
-	}
+	return c.Send(protocol.Safe, handlerId, data)
+}
 
-	packet := append(append(handlerBuf.Bytes(), sizeBuf.Bytes()...), data...)
-	if _, err := c.tcpServer.Write(packet); err != nil {
+func (c *Client) sendSafe(sess *session, handlerId uint32, data []byte) error {
+	if err := protocol.WriteFrame(sess.tcp, handlerId, data, c.MaxMessageSize); err != nil {
 		return err
 	}
-
-	// fmt.Printf("Sent TCP to server: connId=%d, handlerId=%d, size=%d\n", c.Id, handlerId, len(data))
-
+	sess.link.Meter().SentSafe(protocol.FrameHeaderSize + len(data))
 	return nil
 }
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"flera/protocol"
+	"fmt"
+)
+
+// Handle registers a handler that gets messages decoded into T with the
+// Codec of the client.
+func Handle[T any](c *Client, handlerId uint32, h func(c *Client, msg T) error) {
+	c.Register(handlerId, func(c *Client, data []byte) error {
+		var msg T
+		if err := c.Codec.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("decode message for handler %d: %w", handlerId, err)
+		}
+		return h(c, msg)
+	})
+}
+
+// HandleCall registers a call handler that gets calls decoded into T and
+// replies with R, both encoded with the Codec of the client.
+func HandleCall[T, R any](c *Client, handlerId uint32, h func(c *Client, msg T) (R, error)) {
+	c.RegisterCall(handlerId, func(c *Client, data []byte) ([]byte, error) {
+		var msg T
+		if err := c.Codec.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("decode call for handler %d: %w", handlerId, err)
+		}
+
+		reply, err := h(c, msg)
+		if err != nil {
+			return nil, err
+		}
+		return c.Codec.Marshal(reply)
+	})
+}
+
+// Send encodes msg and sends it to handlerId on the server over the given
+// channel.
+func Send[T any](c *Client, ch protocol.Channel, handlerId uint32, msg T) error {
+	data, err := c.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Send(ch, handlerId, data)
+}
+
+// Call encodes msg, calls handlerId on the server and decodes its reply
+// into R.
+func Call[T, R any](ctx context.Context, c *Client, handlerId uint32, msg T) (R, error) {
+	var reply R
+	data, err := c.Codec.Marshal(msg)
+	if err != nil {
+		return reply, err
+	}
+
+	data, err = c.Call(ctx, handlerId, data)
+	if err != nil {
+		return reply, err
+	}
+	err = c.Codec.Unmarshal(data, &reply)
+	return reply, err
+}
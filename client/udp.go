@@ -1,92 +1,96 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"errors"
+	"flera/protocol"
 	"net"
 	"time"
 )
 
-func (c *Client) connectUdp(port string) error {
-	addr, err := net.ResolveUDPAddr("udp", port)
+func (c *Client) connectUdp(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	attempts := 0
 	for {
-		c.udpServer, err = net.DialUDP("udp", nil, addr)
+		conn, err := net.DialUDP("udp", nil, udpAddr)
 		if err != nil {
-			fmt.Println("Failed to connect to udp, will try again in 5 secs")
+			c.logger().Warn("udp connect failed, retrying in 5s", "addr", udpAddr, "err", err)
 			if 5 == attempts {
-				return err
+				return nil, err
 			}
 			attempts++
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		return nil
+		if err := protocol.SetDontFragment(conn); err != nil {
+			c.logger().Warn("can't stop udp fragmentation, the mtu found may be too big", "err", err)
+		}
+		return conn, nil
 	}
 }
 
-func (c *Client) handleUdpConn() {
-	c.udpConnected = true
+func (c *Client) handleUdpConn(sess *session) {
 	defer func() {
-		c.udpConnected = false
-		fmt.Println("udp lost")
+		sess.udpConnected.Store(false)
+		c.logger().Info("udp lost", "connId", sess.id)
+		c.lost(sess, protocol.DisconnectReason{Code: protocol.ConnectionLost})
 	}()
 
-	if err := c.SendFast(^uint32(0), []byte{}); err != nil {
-		fmt.Println(err)
+	if err := sess.link.Send(protocol.Fast, protocol.HandlerHello, []byte{}); err != nil {
+		c.logger().Warn("hello failed", "connId", sess.id, "err", err)
 	}
 
 	// listen for messages
-	buf := make([]byte, c.UdpPacketSize+4)
+	buf := make([]byte, protocol.ReceiveBufferSize(c.UdpPacketSize))
 	for {
-		// fmt.Println("Waiting on udp")
-
-		n, err := c.udpServer.Read(buf)
+		n, err := sess.udp.Read(buf)
 		if err != nil {
-			fmt.Println(err)
+			if !errors.Is(err, net.ErrClosed) {
+				c.logger().Warn("udp read failed", "connId", sess.id, "err", err)
+			}
 			return
 		}
-		// fmt.Println("Got something from udp")
 
-		var handlerId uint32
-		if err := binary.Read(bytes.NewReader(buf[:4]), binary.BigEndian, &handlerId); err != nil {
-			fmt.Println(err)
+		d, err := sess.link.Open(buf[:n])
+		if err != nil {
+			// not from our server
 			continue
 		}
 
-		// fmt.Println(handlerId)
+		// the first datagram from the server means it knows our address,
+		// so the path can be probed
+		if sess.udpSeen.Swap(time.Now().UnixNano()) == 0 {
+			sess.link.DiscoverMTU(sess.udp.RemoteAddr().(*net.UDPAddr).AddrPort().Addr())
+		}
+		for _, m := range sess.link.Receive(d) {
+			if c.handleControl(sess, m.HandlerId, m.Data, true) {
+				continue
+			}
 
-		handler, ok := c.handlers[handlerId]
-		if ok {
-			handler(c, buf[4:n])
-		} else {
-			fmt.Printf("No handler with id %d from udp\n", handlerId)
-			continue
+			if handler, ok := c.handlers[m.HandlerId]; ok {
+				if err := c.invoke(m.HandlerId, handler, m.Data); err != nil {
+					c.fail(sess, m.HandlerId, err)
+				}
+			} else {
+				c.logger().Debug("no handler", "connId", sess.id, "handlerId", m.HandlerId, "channel", d.Channel)
+			}
 		}
 	}
 }
 
 func (c *Client) SendFast(handlerId uint32, data []byte) error {
-	idBuf := new(bytes.Buffer)
-	if err := binary.Write(idBuf, binary.BigEndian, c.Id); err != nil {
-		return err
-	}
-	handlerBuf := new(bytes.Buffer)
-	if err := binary.Write(handlerBuf, binary.BigEndian, handlerId); err != nil {
-		return err
-	}
-
-	packet := append(append(idBuf.Bytes(), handlerBuf.Bytes()...), data...)
-	if _, err := c.udpServer.Write(packet); err != nil {
-		return err
-	}
+	return c.sendUdp(handlerId, data)
+}
 
-	// fmt.Printf("Sent UDP to server: connId=%d, handlerId=%d, size=%d\n", c.Id, handlerId, len(data))
+func (c *Client) sendUdp(handlerId uint32, data []byte) error {
+	return c.Send(protocol.Fast, handlerId, data)
+}
 
-	return nil
+// writeUdp puts a datagram from the link on the wire.
+func (c *Client) writeUdp(sess *session, packet []byte) error {
+	_, err := sess.udp.Write(packet)
+	return err
 }
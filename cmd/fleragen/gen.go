@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+// Generate writes the Go code for schema, source is the name of the schema
+// file mentioned in the header.
+func Generate(schema *Schema, source string) ([]byte, error) {
+	g := new(generator)
+	g.printf("// Code generated by fleragen from %s. DO NOT EDIT.\n\n", source)
+	g.printf("package %s\n\n", schema.Package)
+
+	g.printf("import (\n")
+	g.printf("\t\"encoding/binary\"\n\t\"errors\"\n")
+	if usesFloats(schema) {
+		g.printf("\t\"math\"\n")
+	}
+	g.printf("\n\t\"flera/client\"\n\t\"flera/protocol\"\n\t\"flera/server\"\n)\n\n")
+
+	g.printf("const (\n")
+	for _, m := range schema.Messages {
+		g.printf("\t%sId uint32 = %d\n", m.Name, m.Id)
+	}
+	g.printf(")\n\n")
+
+	for _, m := range schema.Messages {
+		g.message(m)
+	}
+	g.printf("%s", readerSource)
+
+	code, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w", err)
+	}
+	return code, nil
+}
+
+// generatedNames are the package level identifiers generated for a message,
+// %s is its name.
+var generatedNames = []string{
+	"%s", "%sId",
+	"Handle%s", "Send%sTo", "Broadcast%s", "Broadcast%sToRoom",
+	"On%s", "Send%s",
+}
+
+// methodNames are the methods generated on a message, its fields can't be
+// named like them.
+var methodNames = []string{"MarshalBinary", "UnmarshalBinary"}
+
+// helperNames are the identifiers of readerSource.
+var helperNames = []string{"reader", "appendBool"}
+
+type generator struct {
+	buf bytes.Buffer
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) message(m Message) {
+	name, ch := m.Name, channels[m.Channel]
+	if len(m.Doc) == 0 {
+		g.printf("// %s is message %d, sent on the %s channel.\n", name, m.Id, m.Channel)
+	}
+	for _, line := range m.Doc {
+		g.printf("// %s\n", line)
+	}
+	g.printf("type %s struct {\n", name)
+	for _, f := range m.Fields {
+		g.printf("\t%s %s\n", f.Name, goType(f.Type))
+	}
+	g.printf("}\n\n")
+
+	g.printf("func (m %s) MarshalBinary() ([]byte, error) {\n", name)
+	g.printf("\tdata := make([]byte, 0, %d)\n", fixedSize(m))
+	for _, f := range m.Fields {
+		if f.Type.Len > 0 {
+			g.printf("\tfor _, v := range m.%s {\n\t\t%s\n\t}\n", f.Name, encode(f.Type.Elem, "v"))
+		} else {
+			g.printf("\t%s\n", encode(f.Type.Elem, "m."+f.Name))
+		}
+	}
+	g.printf("\treturn data, nil\n}\n\n")
+
+	g.printf("func (m *%s) UnmarshalBinary(data []byte) error {\n", name)
+	g.printf("\tr := reader{data: data}\n")
+	for _, f := range m.Fields {
+		if f.Type.Len > 0 {
+			g.printf("\tfor i := range m.%s {\n\t\tm.%s[i] = %s\n\t}\n", f.Name, f.Name, decode(f.Type.Elem))
+		} else {
+			g.printf("\tm.%s = %s\n", f.Name, decode(f.Type.Elem))
+		}
+	}
+	g.printf("\treturn r.done(%q)\n}\n\n", name)
+
+	// server side
+	g.printf("// Handle%s registers h for %s messages from clients.\n", name, name)
+	g.printf("func Handle%s(s *server.Server, h func(s *server.Server, connId uint32, msg %s) error) {\n", name, name)
+	g.printf("\ts.Register(%sId, func(s *server.Server, connId uint32, data []byte) error {\n", name)
+	g.printf("\t\tvar msg %s\n\t\tif err := msg.UnmarshalBinary(data); err != nil {\n\t\t\treturn err\n\t\t}\n", name)
+	g.printf("\t\treturn h(s, connId, msg)\n\t})\n}\n\n")
+
+	for _, send := range []struct{ fn, doc, params, call string }{
+		{"Send%sTo", "to one client", "connId uint32, ", "s.SendToClient(connId, "},
+		{"Broadcast%s", "to every client", "", "s.Broadcast("},
+		{"Broadcast%sToRoom", "to everyone in a room", "room string, ", "s.BroadcastToRoom(room, "},
+	} {
+		fn := fmt.Sprintf(send.fn, name)
+		g.printf("// %s sends msg %s.\n", fn, send.doc)
+		g.printf("func %s(s *server.Server, %smsg %s) error {\n", fn, send.params, name)
+		g.printf("\tdata, _ := msg.MarshalBinary()\n")
+		g.printf("\treturn %s%s, %sId, data)\n}\n\n", send.call, ch, name)
+	}
+
+	// client side
+	g.printf("// On%s registers h for %s messages from the server.\n", name, name)
+	g.printf("func On%s(c *client.Client, h func(c *client.Client, msg %s) error) {\n", name, name)
+	g.printf("\tc.Register(%sId, func(c *client.Client, data []byte) error {\n", name)
+	g.printf("\t\tvar msg %s\n\t\tif err := msg.UnmarshalBinary(data); err != nil {\n\t\t\treturn err\n\t\t}\n", name)
+	g.printf("\t\treturn h(c, msg)\n\t})\n}\n\n")
+
+	g.printf("// Send%s sends msg to the server.\n", name)
+	g.printf("func Send%s(c *client.Client, msg %s) error {\n", name, name)
+	g.printf("\tdata, _ := msg.MarshalBinary()\n")
+	g.printf("\treturn c.Send(%s, %sId, data)\n}\n\n", ch, name)
+}
+
+func goType(t Type) string {
+	elem := t.Elem
+	if elem == "bytes" {
+		elem = "[]byte"
+	}
+	if t.Len > 0 {
+		return fmt.Sprintf("[%d]%s", t.Len, elem)
+	}
+	return elem
+}
+
+// fixedSize is the size of the fixed size fields of m, strings and bytes
+// only count their length.
+func fixedSize(m Message) int {
+	size := 0
+	for _, f := range m.Fields {
+		n, ok := sizes[f.Type.Elem]
+		if !ok {
+			n = 4
+		}
+		size += n * max(f.Type.Len, 1)
+	}
+	return size
+}
+
+func encode(elem, v string) string {
+	switch elem {
+	case "bool":
+		return fmt.Sprintf("data = appendBool(data, %s)", v)
+	case "uint8":
+		return fmt.Sprintf("data = append(data, %s)", v)
+	case "int8":
+		return fmt.Sprintf("data = append(data, byte(%s))", v)
+	case "uint16", "uint32", "uint64":
+		return fmt.Sprintf("data = binary.BigEndian.Append%s(data, %s)", title(elem), v)
+	case "int16", "int32", "int64":
+		return fmt.Sprintf("data = binary.BigEndian.AppendU%s(data, u%s(%s))", elem, elem, v)
+	case "float32":
+		return fmt.Sprintf("data = binary.BigEndian.AppendUint32(data, math.Float32bits(%s))", v)
+	case "float64":
+		return fmt.Sprintf("data = binary.BigEndian.AppendUint64(data, math.Float64bits(%s))", v)
+	default: // string, bytes
+		return fmt.Sprintf("data = binary.BigEndian.AppendUint32(data, uint32(len(%s)))\n\tdata = append(data, %s...)", v, v)
+	}
+}
+
+func decode(elem string) string {
+	switch elem {
+	case "bool":
+		return "r.uint8() != 0"
+	case "uint8", "uint16", "uint32", "uint64":
+		return fmt.Sprintf("r.%s()", elem)
+	case "int8", "int16", "int32", "int64":
+		return fmt.Sprintf("%s(r.u%s())", elem, elem)
+	case "float32":
+		return "math.Float32frombits(r.uint32())"
+	case "float64":
+		return "math.Float64frombits(r.uint64())"
+	case "string":
+		return "string(r.bytes())"
+	default: // bytes, copied as data is reused after the handler
+		return "append([]byte(nil), r.bytes()...)"
+	}
+}
+
+func title(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func usesFloats(schema *Schema) bool {
+	for _, m := range schema.Messages {
+		for _, f := range m.Fields {
+			if strings.HasPrefix(f.Type.Elem, "float") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const readerSource = `func appendBool(data []byte, v bool) []byte {
+	if v {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// reader decodes the fields of a message in order, once data ran out it
+// only returns zero values.
+type reader struct {
+	data  []byte
+	short bool
+}
+
+func (r *reader) next(n int) []byte {
+	if r.short || n < 0 || n > len(r.data) {
+		r.short = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *reader) done(name string) error {
+	if r.short {
+		return errors.New(name + ": message too short")
+	}
+	if len(r.data) > 0 {
+		return errors.New(name + ": message too long")
+	}
+	return nil
+}
+`
@@ -0,0 +1,58 @@
+// Command fleragen generates Go code from a flera message schema: a
+// constant with the handler id of every message, a struct with
+// MarshalBinary and UnmarshalBinary, and typed helpers to register and send
+// it on the server and the client.
+//
+// Usage:
+//
+//	fleragen [-o out.go] schema.flera
+//
+// Put it next to the schema with a go:generate comment:
+//
+//	//go:generate go run flera/cmd/fleragen messages.flera
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	out := flag.String("o", "", "output file, defaults to the schema file with a .go extension")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fleragen [-o out.go] schema.flera")
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *out); err != nil {
+		fmt.Fprintln(os.Stderr, "fleragen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, out string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	schema, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	code, err := Generate(schema, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		out = strings.TrimSuffix(path, filepath.Ext(path)) + ".go"
+	}
+	return os.WriteFile(out, code, 0o644)
+}
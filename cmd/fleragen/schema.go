@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"flera/protocol"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Schema is a parsed schema file.
+type Schema struct {
+	Package  string
+	Messages []Message
+}
+
+type Message struct {
+	Name    string
+	Id      uint32
+	Channel string
+	Doc     []string
+	Fields  []Field
+}
+
+type Field struct {
+	Name string
+	Type Type
+}
+
+// Type is a field type. Len is the length of an array, 0 for everything
+// else, in which case Elem is the type itself.
+type Type struct {
+	Len  int
+	Elem string
+}
+
+// channels maps the channel names of the schema to the protocol constants.
+var channels = map[string]string{
+	"safe":             "protocol.Safe",
+	"fast":             "protocol.Fast",
+	"sequenced":        "protocol.Sequenced",
+	"reliable":         "protocol.Reliable",
+	"reliable_ordered": "protocol.ReliableOrdered",
+}
+
+// sizes are the encoded sizes of the fixed size types.
+var sizes = map[string]int{
+	"bool":    1,
+	"uint8":   1,
+	"int8":    1,
+	"uint16":  2,
+	"int16":   2,
+	"uint32":  4,
+	"int32":   4,
+	"float32": 4,
+	"uint64":  8,
+	"int64":   8,
+	"float64": 8,
+}
+
+// Parse reads a schema:
+//
+//	package messages
+//
+//	# Move places a mark on the board.
+//	message Move 4 safe {
+//		X     uint8
+//		Y     uint8
+//		Board [9]uint8
+//		Chat  string
+//	}
+//
+// Comments start with #, the ones right above a message become its doc
+// comment.
+func Parse(r io.Reader) (*Schema, error) {
+	schema := new(Schema)
+	names := make(map[string]bool)
+	ids := make(map[uint32]string)
+	// idents maps the generated identifiers to the message they are
+	// generated for, the helpers to none
+	idents := make(map[string]string)
+	for _, ident := range helperNames {
+		idents[ident] = ""
+	}
+
+	var doc []string
+	var msg *Message
+	fields := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if comment, ok := strings.CutPrefix(text, "#"); ok {
+			if msg == nil {
+				doc = append(doc, strings.TrimSpace(comment))
+			}
+			continue
+		}
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			doc = nil
+			continue
+		}
+		words := strings.Fields(text)
+
+		fail := func(format string, args ...any) (*Schema, error) {
+			return nil, fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+		}
+
+		if msg != nil {
+			if text == "}" {
+				schema.Messages = append(schema.Messages, *msg)
+				msg = nil
+				continue
+			}
+			if len(words) != 2 {
+				return fail("expected a field name and type, got %q", text)
+			}
+			if !exported(words[0]) {
+				return fail("field %s has to start with an upper case letter", words[0])
+			}
+			if fields[words[0]] {
+				return fail("field %s is declared twice", words[0])
+			}
+			if slices.Contains(methodNames, words[0]) {
+				return fail("field %s clashes with the generated method of the same name", words[0])
+			}
+			t, err := parseType(words[1])
+			if err != nil {
+				return fail("%v", err)
+			}
+			fields[words[0]] = true
+			msg.Fields = append(msg.Fields, Field{Name: words[0], Type: t})
+			continue
+		}
+
+		switch words[0] {
+		case "package":
+			if len(words) != 2 || schema.Package != "" {
+				return fail("expected a single package name")
+			}
+			schema.Package = words[1]
+			doc = nil
+		case "message":
+			if len(words) != 5 || words[4] != "{" {
+				return fail("expected message <Name> <id> <channel> {")
+			}
+			name := words[1]
+			if !exported(name) {
+				return fail("message %s has to start with an upper case letter", name)
+			}
+			if names[name] {
+				return fail("message %s is declared twice", name)
+			}
+			id, err := strconv.ParseUint(words[2], 0, 32)
+			if err != nil {
+				return fail("bad id %q", words[2])
+			}
+			if protocol.IsReserved(uint32(id)) {
+				return fail("id %d is reserved", id)
+			}
+			if other, ok := ids[uint32(id)]; ok {
+				return fail("message %s has the same id as %s", name, other)
+			}
+			if _, ok := channels[words[3]]; !ok {
+				return fail("unknown channel %q", words[3])
+			}
+			for _, format := range generatedNames {
+				ident := fmt.Sprintf(format, name)
+				other, ok := idents[ident]
+				if !ok {
+					continue
+				}
+				if other == "" {
+					return fail("message %s generates %s, which the generated code already uses", name, ident)
+				}
+				return fail("message %s generates %s, which message %s generates too", name, ident, other)
+			}
+			for _, format := range generatedNames {
+				idents[fmt.Sprintf(format, name)] = name
+			}
+
+			names[name] = true
+			ids[uint32(id)] = name
+			msg = &Message{Name: name, Id: uint32(id), Channel: words[3], Doc: doc}
+			fields = make(map[string]bool)
+			doc = nil
+		default:
+			return fail("unexpected %q", words[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if msg != nil {
+		return nil, fmt.Errorf("message %s is not closed", msg.Name)
+	}
+	if schema.Package == "" {
+		return nil, fmt.Errorf("missing package")
+	}
+	return schema, nil
+}
+
+func parseType(s string) (Type, error) {
+	switch s {
+	case "byte":
+		return Type{Elem: "uint8"}, nil
+	case "string", "bytes":
+		return Type{Elem: s}, nil
+	}
+	if _, ok := sizes[s]; ok {
+		return Type{Elem: s}, nil
+	}
+
+	if rest, ok := strings.CutPrefix(s, "["); ok {
+		n, elem, ok := strings.Cut(rest, "]")
+		length, err := strconv.Atoi(n)
+		if !ok || err != nil || length <= 0 {
+			return Type{}, fmt.Errorf("bad array type %q", s)
+		}
+		if elem == "byte" {
+			elem = "uint8"
+		}
+		if _, ok := sizes[elem]; !ok {
+			return Type{}, fmt.Errorf("arrays can only hold fixed size types, not %q", elem)
+		}
+		return Type{Len: length, Elem: elem}, nil
+	}
+	return Type{}, fmt.Errorf("unknown type %q", s)
+}
+
+func exported(name string) bool {
+	for i, r := range name {
+		if i == 0 && !unicode.IsUpper(r) {
+			return false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
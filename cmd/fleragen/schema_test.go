@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flera/protocol"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	schema, err := Parse(strings.NewReader(`package messages
+
+# Move places a mark on the board.
+message Move 4 safe {
+	X     uint8
+	Board [9]byte  # row by row
+	Chat  string
+}
+
+message Ping 0x10 fast {
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Package != "messages" || len(schema.Messages) != 2 {
+		t.Fatalf("parsed package %q with %d messages", schema.Package, len(schema.Messages))
+	}
+
+	move := schema.Messages[0]
+	if move.Name != "Move" || move.Id != 4 || move.Channel != "safe" {
+		t.Errorf("parsed message %s %d %s", move.Name, move.Id, move.Channel)
+	}
+	if len(move.Doc) != 1 || move.Doc[0] != "Move places a mark on the board." {
+		t.Errorf("parsed doc %q", move.Doc)
+	}
+	want := []Field{
+		{"X", Type{Elem: "uint8"}},
+		{"Board", Type{Len: 9, Elem: "uint8"}},
+		{"Chat", Type{Elem: "string"}},
+	}
+	if fmt.Sprint(move.Fields) != fmt.Sprint(want) {
+		t.Errorf("parsed fields %v, want %v", move.Fields, want)
+	}
+	if ping := schema.Messages[1]; ping.Id != 0x10 || len(ping.Fields) != 0 {
+		t.Errorf("parsed message %s %d with %d fields", ping.Name, ping.Id, len(ping.Fields))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			"duplicate id",
+			"package p\nmessage A 1 safe {\n}\nmessage B 1 safe {\n}",
+			"line 4: message B has the same id as A",
+		},
+		{
+			"duplicate name",
+			"package p\nmessage A 1 safe {\n}\nmessage A 2 safe {\n}",
+			"line 4: message A is declared twice",
+		},
+		{
+			"reserved id",
+			fmt.Sprintf("package p\nmessage A %d safe {\n}", protocol.ReservedHandlerIds),
+			fmt.Sprintf("line 2: id %d is reserved", protocol.ReservedHandlerIds),
+		},
+		{
+			"last reserved id",
+			"package p\nmessage A 0xffffffff safe {\n}",
+			"line 2: id 4294967295 is reserved",
+		},
+		{
+			"id too big",
+			"package p\nmessage A 0x100000000 safe {\n}",
+			`line 2: bad id "0x100000000"`,
+		},
+		{
+			"unknown channel",
+			"package p\nmessage A 1 slow {\n}",
+			`line 2: unknown channel "slow"`,
+		},
+		{
+			"array of strings",
+			"package p\nmessage A 1 safe {\n\tB [4]string\n}",
+			`line 3: arrays can only hold fixed size types, not "string"`,
+		},
+		{
+			"array of arrays",
+			"package p\nmessage A 1 safe {\n\tB [4][4]uint8\n}",
+			`line 3: arrays can only hold fixed size types, not "[4]uint8"`,
+		},
+		{
+			"empty array",
+			"package p\nmessage A 1 safe {\n\tB [0]uint8\n}",
+			`line 3: bad array type "[0]uint8"`,
+		},
+		{
+			"array without length",
+			"package p\nmessage A 1 safe {\n\tB []uint8\n}",
+			`line 3: bad array type "[]uint8"`,
+		},
+		{
+			"unclosed array",
+			"package p\nmessage A 1 safe {\n\tB [4uint8\n}",
+			`line 3: bad array type "[4uint8"`,
+		},
+		{
+			"unknown type",
+			"package p\nmessage A 1 safe {\n\tB int\n}",
+			`line 3: unknown type "int"`,
+		},
+		{
+			"duplicate field",
+			"package p\nmessage A 1 safe {\n\tB uint8\n\tB uint16\n}",
+			"line 4: field B is declared twice",
+		},
+		{
+			"unexported field",
+			"package p\nmessage A 1 safe {\n\tb uint8\n}",
+			"line 3: field b has to start with an upper case letter",
+		},
+		{
+			"field named MarshalBinary",
+			"package p\nmessage A 1 safe {\n\tMarshalBinary bytes\n}",
+			"line 3: field MarshalBinary clashes with the generated method of the same name",
+		},
+		{
+			"field named UnmarshalBinary",
+			"package p\nmessage A 1 safe {\n\tUnmarshalBinary bool\n}",
+			"line 3: field UnmarshalBinary clashes with the generated method of the same name",
+		},
+		{
+			"message generating the send of another",
+			"package p\nmessage Move 1 safe {\n}\nmessage MoveTo 2 safe {\n}",
+			"line 4: message MoveTo generates SendMoveTo, which message Move generates too",
+		},
+		{
+			"message generating the id of another",
+			"package p\nmessage Move 1 safe {\n}\nmessage MoveId 2 safe {\n}",
+			"line 4: message MoveId generates MoveId, which message Move generates too",
+		},
+		{
+			"message named like the id of another",
+			"package p\nmessage MoveId 1 safe {\n}\nmessage Move 2 safe {\n}",
+			"line 4: message Move generates MoveId, which message MoveId generates too",
+		},
+		{
+			"message named like the handler of another",
+			"package p\nmessage Move 1 safe {\n}\nmessage HandleMove 2 safe {\n}",
+			"line 4: message HandleMove generates HandleMove, which message Move generates too",
+		},
+		{
+			"unclosed message",
+			"package p\nmessage A 1 safe {\n\tB uint8",
+			"message A is not closed",
+		},
+		{
+			"missing package",
+			"message A 1 safe {\n}",
+			"missing package",
+		},
+		{
+			"second package",
+			"package p\npackage q",
+			"line 2: expected a single package name",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.schema))
+			if err == nil {
+				t.Fatalf("parsed, want %q", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
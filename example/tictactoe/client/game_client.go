@@ -1,20 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"flera/client"
+	"flera/example/tictactoe/messages"
 	"fmt"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
-const (
-	SET_TEAM     uint32 = 1
-	UPDATE_STATE uint32 = 2
-	MOUSE_POS    uint32 = 3
-)
-
 var playerTurn bool = false
 var team int = 0
 var mouseDown bool = false
@@ -31,9 +24,10 @@ func main() {
 	}
 	// client setup
 	c := client.New()
-	c.Register(SET_TEAM, SetTeam)
-	c.Register(UPDATE_STATE, UpdateState)
-	c.Register(MOUSE_POS, MousePos)
+	defer c.Close()
+	messages.OnSetTeam(c, SetTeam)
+	messages.OnState(c, UpdateState)
+	messages.OnMousePos(c, MousePos)
 	// rl setup
 	rl.SetConfigFlags(rl.FlagWindowResizable)
 	rl.InitWindow(800, 450, "Client")
@@ -66,10 +60,9 @@ func main() {
 				x, y, ok := board.Click()
 
 				if ok && board.State[x][y] == 0 {
-					data := []byte{uint8(x), uint8(y)}
 					playerTurn = false
 					board.State[x][y] = team
-					c.SendSafe(UPDATE_STATE, data)
+					messages.SendMove(c, messages.Move{X: uint8(x), Y: uint8(y)})
 				}
 			}
 
@@ -84,20 +77,8 @@ func main() {
 
 			xPad, yPad, size := board.GetScreenBounds()
 			x := (mousePos.X - float32(xPad)) / float32(size)
-			xBuf := new(bytes.Buffer)
-			if err := binary.Write(xBuf, binary.BigEndian, x); err != nil {
-				fmt.Println(err)
-				continue
-			}
-
 			y := (mousePos.Y - float32(yPad)) / float32(size)
-			yBuf := new(bytes.Buffer)
-			if err := binary.Write(yBuf, binary.BigEndian, y); err != nil {
-				fmt.Println(err)
-				continue
-			}
-			data := append(xBuf.Bytes(), yBuf.Bytes()...)
-			if err := c.SendFast(MOUSE_POS, data); err != nil {
+			if err := messages.SendMousePos(c, messages.MousePos{X: x, Y: y}); err != nil {
 				fmt.Println(err)
 			}
 
@@ -108,8 +89,8 @@ func main() {
 	}
 }
 
-func SetTeam(c *client.Client, data []byte) error {
-	team = int(data[0])
+func SetTeam(c *client.Client, msg messages.SetTeam) error {
+	team = int(msg.Team)
 	if team == 1 {
 		playerTurn = true
 	}
@@ -121,49 +102,33 @@ func SetTeam(c *client.Client, data []byte) error {
 	return nil
 }
 
-func UpdateState(c *client.Client, data []byte) error {
-	fmt.Println(data)
-	if int(data[0]) == team {
+func UpdateState(c *client.Client, msg messages.State) error {
+	fmt.Println(msg)
+	if int(msg.Turn) == team {
 		playerTurn = true
 	} else {
 		playerTurn = false
 	}
 
-	winner = int(data[1])
+	winner = int(msg.Winner)
 
-	state := data[2:]
-	for i := range state {
+	for i := range msg.Board {
 		x := i % 3
 		y := i / 3
-		fmt.Printf("x: %d y: %d\n", x, y)
-		board.State[x][y] = int(state[i])
+		board.State[x][y] = int(msg.Board[i])
 	}
 	return nil
 }
 
-func MousePos(c *client.Client, data []byte) error {
-	var id uint32
-	if err := binary.Read(bytes.NewReader(data[:4]), binary.BigEndian, &id); err != nil {
-		return err
-	}
-
-	if id == c.Id {
+func MousePos(c *client.Client, msg messages.MousePos) error {
+	if msg.Player == c.Id() {
 		return nil
 	}
-	var x float32
-	if err := binary.Read(bytes.NewReader(data[4:8]), binary.BigEndian, &x); err != nil {
-		return err
-	}
-
-	var y float32
-	if err := binary.Read(bytes.NewReader(data[8:]), binary.BigEndian, &y); err != nil {
-		return err
-	}
 
 	xPad, yPad, size := board.GetScreenBounds()
 
-	oppX = int32(float32(xPad) + x*float32(size))
-	oppY = int32(float32(yPad) + y*float32(size))
+	oppX = int32(float32(xPad) + msg.X*float32(size))
+	oppY = int32(float32(yPad) + msg.Y*float32(size))
 
 	return nil
 }
@@ -0,0 +1,5 @@
+// Package messages holds the messages of the tictactoe example, generated
+// from messages.flera.
+package messages
+
+//go:generate go run flera/cmd/fleragen messages.flera
@@ -0,0 +1,359 @@
+// Code generated by fleragen from messages.flera. DO NOT EDIT.
+
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"flera/client"
+	"flera/protocol"
+	"flera/server"
+)
+
+const (
+	SetTeamId  uint32 = 1
+	StateId    uint32 = 2
+	MousePosId uint32 = 3
+	MoveId     uint32 = 4
+)
+
+// SetTeam tells a player which team it plays for, team 1 starts.
+type SetTeam struct {
+	Team uint8
+}
+
+func (m SetTeam) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 1)
+	data = append(data, m.Team)
+	return data, nil
+}
+
+func (m *SetTeam) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	m.Team = r.uint8()
+	return r.done("SetTeam")
+}
+
+// HandleSetTeam registers h for SetTeam messages from clients.
+func HandleSetTeam(s *server.Server, h func(s *server.Server, connId uint32, msg SetTeam) error) {
+	s.Register(SetTeamId, func(s *server.Server, connId uint32, data []byte) error {
+		var msg SetTeam
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(s, connId, msg)
+	})
+}
+
+// SendSetTeamTo sends msg to one client.
+func SendSetTeamTo(s *server.Server, connId uint32, msg SetTeam) error {
+	data, _ := msg.MarshalBinary()
+	return s.SendToClient(connId, protocol.Safe, SetTeamId, data)
+}
+
+// BroadcastSetTeam sends msg to every client.
+func BroadcastSetTeam(s *server.Server, msg SetTeam) error {
+	data, _ := msg.MarshalBinary()
+	return s.Broadcast(protocol.Safe, SetTeamId, data)
+}
+
+// BroadcastSetTeamToRoom sends msg to everyone in a room.
+func BroadcastSetTeamToRoom(s *server.Server, room string, msg SetTeam) error {
+	data, _ := msg.MarshalBinary()
+	return s.BroadcastToRoom(room, protocol.Safe, SetTeamId, data)
+}
+
+// OnSetTeam registers h for SetTeam messages from the server.
+func OnSetTeam(c *client.Client, h func(c *client.Client, msg SetTeam) error) {
+	c.Register(SetTeamId, func(c *client.Client, data []byte) error {
+		var msg SetTeam
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(c, msg)
+	})
+}
+
+// SendSetTeam sends msg to the server.
+func SendSetTeam(c *client.Client, msg SetTeam) error {
+	data, _ := msg.MarshalBinary()
+	return c.Send(protocol.Safe, SetTeamId, data)
+}
+
+// State is the board after a move, sent to both players. Board holds the
+// team owning each cell, row by row, 0 for empty ones.
+type State struct {
+	Turn   uint8
+	Winner uint8
+	Board  [9]uint8
+}
+
+func (m State) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 11)
+	data = append(data, m.Turn)
+	data = append(data, m.Winner)
+	for _, v := range m.Board {
+		data = append(data, v)
+	}
+	return data, nil
+}
+
+func (m *State) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	m.Turn = r.uint8()
+	m.Winner = r.uint8()
+	for i := range m.Board {
+		m.Board[i] = r.uint8()
+	}
+	return r.done("State")
+}
+
+// HandleState registers h for State messages from clients.
+func HandleState(s *server.Server, h func(s *server.Server, connId uint32, msg State) error) {
+	s.Register(StateId, func(s *server.Server, connId uint32, data []byte) error {
+		var msg State
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(s, connId, msg)
+	})
+}
+
+// SendStateTo sends msg to one client.
+func SendStateTo(s *server.Server, connId uint32, msg State) error {
+	data, _ := msg.MarshalBinary()
+	return s.SendToClient(connId, protocol.Safe, StateId, data)
+}
+
+// BroadcastState sends msg to every client.
+func BroadcastState(s *server.Server, msg State) error {
+	data, _ := msg.MarshalBinary()
+	return s.Broadcast(protocol.Safe, StateId, data)
+}
+
+// BroadcastStateToRoom sends msg to everyone in a room.
+func BroadcastStateToRoom(s *server.Server, room string, msg State) error {
+	data, _ := msg.MarshalBinary()
+	return s.BroadcastToRoom(room, protocol.Safe, StateId, data)
+}
+
+// OnState registers h for State messages from the server.
+func OnState(c *client.Client, h func(c *client.Client, msg State) error) {
+	c.Register(StateId, func(c *client.Client, data []byte) error {
+		var msg State
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(c, msg)
+	})
+}
+
+// SendState sends msg to the server.
+func SendState(c *client.Client, msg State) error {
+	data, _ := msg.MarshalBinary()
+	return c.Send(protocol.Safe, StateId, data)
+}
+
+// MousePos is where the mouse of a player is, relative to the board.
+// Clients leave Player empty, the server fills it in when passing it on.
+type MousePos struct {
+	Player uint32
+	X      float32
+	Y      float32
+}
+
+func (m MousePos) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 12)
+	data = binary.BigEndian.AppendUint32(data, m.Player)
+	data = binary.BigEndian.AppendUint32(data, math.Float32bits(m.X))
+	data = binary.BigEndian.AppendUint32(data, math.Float32bits(m.Y))
+	return data, nil
+}
+
+func (m *MousePos) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	m.Player = r.uint32()
+	m.X = math.Float32frombits(r.uint32())
+	m.Y = math.Float32frombits(r.uint32())
+	return r.done("MousePos")
+}
+
+// HandleMousePos registers h for MousePos messages from clients.
+func HandleMousePos(s *server.Server, h func(s *server.Server, connId uint32, msg MousePos) error) {
+	s.Register(MousePosId, func(s *server.Server, connId uint32, data []byte) error {
+		var msg MousePos
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(s, connId, msg)
+	})
+}
+
+// SendMousePosTo sends msg to one client.
+func SendMousePosTo(s *server.Server, connId uint32, msg MousePos) error {
+	data, _ := msg.MarshalBinary()
+	return s.SendToClient(connId, protocol.Fast, MousePosId, data)
+}
+
+// BroadcastMousePos sends msg to every client.
+func BroadcastMousePos(s *server.Server, msg MousePos) error {
+	data, _ := msg.MarshalBinary()
+	return s.Broadcast(protocol.Fast, MousePosId, data)
+}
+
+// BroadcastMousePosToRoom sends msg to everyone in a room.
+func BroadcastMousePosToRoom(s *server.Server, room string, msg MousePos) error {
+	data, _ := msg.MarshalBinary()
+	return s.BroadcastToRoom(room, protocol.Fast, MousePosId, data)
+}
+
+// OnMousePos registers h for MousePos messages from the server.
+func OnMousePos(c *client.Client, h func(c *client.Client, msg MousePos) error) {
+	c.Register(MousePosId, func(c *client.Client, data []byte) error {
+		var msg MousePos
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(c, msg)
+	})
+}
+
+// SendMousePos sends msg to the server.
+func SendMousePos(c *client.Client, msg MousePos) error {
+	data, _ := msg.MarshalBinary()
+	return c.Send(protocol.Fast, MousePosId, data)
+}
+
+// Move places the mark of the player on a cell.
+type Move struct {
+	X uint8
+	Y uint8
+}
+
+func (m Move) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 2)
+	data = append(data, m.X)
+	data = append(data, m.Y)
+	return data, nil
+}
+
+func (m *Move) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	m.X = r.uint8()
+	m.Y = r.uint8()
+	return r.done("Move")
+}
+
+// HandleMove registers h for Move messages from clients.
+func HandleMove(s *server.Server, h func(s *server.Server, connId uint32, msg Move) error) {
+	s.Register(MoveId, func(s *server.Server, connId uint32, data []byte) error {
+		var msg Move
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(s, connId, msg)
+	})
+}
+
+// SendMoveTo sends msg to one client.
+func SendMoveTo(s *server.Server, connId uint32, msg Move) error {
+	data, _ := msg.MarshalBinary()
+	return s.SendToClient(connId, protocol.Safe, MoveId, data)
+}
+
+// BroadcastMove sends msg to every client.
+func BroadcastMove(s *server.Server, msg Move) error {
+	data, _ := msg.MarshalBinary()
+	return s.Broadcast(protocol.Safe, MoveId, data)
+}
+
+// BroadcastMoveToRoom sends msg to everyone in a room.
+func BroadcastMoveToRoom(s *server.Server, room string, msg Move) error {
+	data, _ := msg.MarshalBinary()
+	return s.BroadcastToRoom(room, protocol.Safe, MoveId, data)
+}
+
+// OnMove registers h for Move messages from the server.
+func OnMove(c *client.Client, h func(c *client.Client, msg Move) error) {
+	c.Register(MoveId, func(c *client.Client, data []byte) error {
+		var msg Move
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return h(c, msg)
+	})
+}
+
+// SendMove sends msg to the server.
+func SendMove(c *client.Client, msg Move) error {
+	data, _ := msg.MarshalBinary()
+	return c.Send(protocol.Safe, MoveId, data)
+}
+
+func appendBool(data []byte, v bool) []byte {
+	if v {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// reader decodes the fields of a message in order, once data ran out it
+// only returns zero values.
+type reader struct {
+	data  []byte
+	short bool
+}
+
+func (r *reader) next(n int) []byte {
+	if r.short || n < 0 || n > len(r.data) {
+		r.short = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *reader) done(name string) error {
+	if r.short {
+		return errors.New(name + ": message too short")
+	}
+	if len(r.data) > 0 {
+		return errors.New(name + ": message too long")
+	}
+	return nil
+}
@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flera/example/tictactoe/messages"
 	"flera/server"
 	"fmt"
+	"os"
+	"os/signal"
 	"sync"
-)
-
-const (
-	SET_TEAM     uint32 = 1
-	UPDATE_STATE uint32 = 2
-	MOUSE_POS    uint32 = 3
+	"syscall"
 )
 
 type Client struct {
@@ -19,86 +17,87 @@ type Client struct {
 	TeamId int
 }
 
-var teamA *Client
-var teamB *Client
-var curTeam *Client
-var state [][]int
+// Game is one match, played by the two clients in its room.
+type Game struct {
+	Room    string
+	teamA   *Client
+	teamB   *Client
+	curTeam *Client
+	state   [][]int
+	mu      sync.Mutex
+}
+
+var games = make(map[string]*Game)
+var players = make(map[uint32]*Game)
+var nextGame int
 var mu sync.Mutex
 
 func main() {
-	state = make([][]int, 3)
-	for i := range state {
-		state[i] = make([]int, 3)
-	}
-
 	s := server.New()
 	s.OnConn = OnConn
-	s.OnDisConn = OnDisConn
+	s.OnRoomLeave = OnRoomLeave
 
-	s.Register(UPDATE_STATE, UpdateState)
-	s.Register(MOUSE_POS, MousePos)
-	fmt.Println(s.Start(":2489"))
-}
+	messages.HandleMove(s, Move)
+	messages.HandleMousePos(s, MousePos)
 
-func MousePos(s *server.Server, connId uint32, data []byte) error {
-	// var x float32
-	// if err := binary.Read(bytes.NewReader(data[:4]), binary.BigEndian, &x); err != nil {
-	// 	return err
-	// }
-	// var y float32
-	// if err := binary.Read(bytes.NewReader(data[4:]), binary.BigEndian, &y); err != nil {
-	// 	return err
-	// }
-
-	idBuf := new(bytes.Buffer)
-	if err := binary.Write(idBuf, binary.BigEndian, connId); err != nil {
-		return err
-	}
-	packet := append(idBuf.Bytes(), data...)
-	// fmt.Println("TICK")
-	return s.BroadcastFast(MOUSE_POS, packet)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := s.Start(ctx, ":2489"); !errors.Is(err, server.ErrServerClosed) {
+		fmt.Println(err)
+	}
 }
 
-func UpdateState(s *server.Server, connId uint32, data []byte) error {
+func gameOf(connId uint32) *Game {
 	mu.Lock()
 	defer mu.Unlock()
-	if curTeam.Id != connId {
+	return players[connId]
+}
+
+func MousePos(s *server.Server, connId uint32, msg messages.MousePos) error {
+	game := gameOf(connId)
+	if game == nil {
+		return nil
+	}
+	msg.Player = connId
+	return messages.BroadcastMousePosToRoom(s, game.Room, msg)
+}
+
+func Move(s *server.Server, connId uint32, msg messages.Move) error {
+	game := gameOf(connId)
+	if game == nil {
 		return nil
 	}
 
-	x := int(data[0])
-	y := int(data[1])
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	curTeam, state := game.curTeam, game.state
+	if curTeam == nil || curTeam.Id != connId {
+		return nil
+	}
+
+	x := int(msg.X)
+	y := int(msg.Y)
+	if x > 2 || y > 2 {
+		return fmt.Errorf("conn %d moved outside the board: %d, %d", connId, x, y)
+	}
 
 	if state[x][y] == 0 {
 		state[x][y] = int(curTeam.TeamId)
-	} else {
-		stateData := make([]byte, 10)
-		stateData[0] = uint8(curTeam.TeamId)
-		for i := 1; i < len(stateData); i++ {
-			x = (i - 1) % 3
-			y = (i - 1) / 3
-			stateData[i] = uint8(state[x][y])
+		if curTeam == game.teamA {
+			game.curTeam = game.teamB
+		} else {
+			game.curTeam = game.teamA
 		}
-		return s.BroadcastSafe(UPDATE_STATE, stateData)
 	}
 
-	if curTeam == teamA {
-		curTeam = teamB
-	} else {
-		curTeam = teamA
+	update := messages.State{
+		Turn:   uint8(game.curTeam.TeamId),
+		Winner: uint8(checkWin(state)),
 	}
-
-	stateData := make([]byte, 11)
-	stateData[0] = uint8(curTeam.TeamId)
-	stateData[1] = uint8(checkWin(state))
-	for i := 2; i < len(stateData); i++ {
-		x = (i - 2) % 3
-		y = (i - 2) / 3
-		stateData[i] = uint8(state[x][y])
+	for i := range update.Board {
+		update.Board[i] = uint8(state[i%3][i/3])
 	}
-
-	s.BroadcastFast(4, []byte("hello, world"))
-	return s.BroadcastSafe(UPDATE_STATE, stateData)
+	return messages.BroadcastStateToRoom(s, game.Room, update)
 }
 
 func checkWin(board [][]int) int {
@@ -125,47 +124,85 @@ func checkWin(board [][]int) int {
 	return 0
 }
 
+// OnConn seats the client in a game that waits for a second player, or
+// opens a new one.
 func OnConn(s *server.Server, connId uint32) {
 	mu.Lock()
 	defer mu.Unlock()
-	if teamA == nil {
-		teamA = &Client{
-			Id:     connId,
-			TeamId: 1,
+	var game *Game
+	for _, g := range games {
+		g.mu.Lock()
+		open := g.teamA == nil || g.teamB == nil
+		g.mu.Unlock()
+		if open {
+			game = g
+			break
 		}
-	} else if teamB == nil {
-		teamB = &Client{
-			Id:     connId,
-			TeamId: 2,
+	}
+	if game == nil {
+		nextGame++
+		game = &Game{Room: fmt.Sprintf("game-%d", nextGame), state: make([][]int, 3)}
+		for i := range game.state {
+			game.state[i] = make([]int, 3)
 		}
-	} else {
-		// Cick player
+		if err := s.CreateRoom(game.Room); err != nil {
+			fmt.Println(err)
+			_ = s.Kick(connId, "no game available")
+			return
+		}
+		games[game.Room] = game
+	}
+	if err := s.JoinRoom(game.Room, connId); err != nil {
+		fmt.Println(err)
 		return
 	}
+	players[connId] = game
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	if game.teamA == nil {
+		game.teamA = &Client{Id: connId, TeamId: 1}
+	} else {
+		game.teamB = &Client{Id: connId, TeamId: 2}
+	}
 
-	if teamA != nil && teamB != nil {
-		for x := range state {
-			for y := range state[x] {
-				state[x][y] = 0
+	if game.teamA != nil && game.teamB != nil {
+		for x := range game.state {
+			for y := range game.state[x] {
+				game.state[x][y] = 0
 			}
 		}
 
-		dataA := []byte{byte(teamA.TeamId)} // true
-		_ = s.SendToClientSafe(teamA.Id, SET_TEAM, dataA)
-
-		dataB := []byte{byte(teamB.TeamId)} // true
-		_ = s.SendToClientSafe(teamB.Id, SET_TEAM, dataB)
+		_ = messages.SendSetTeamTo(s, game.teamA.Id, messages.SetTeam{Team: uint8(game.teamA.TeamId)})
+		_ = messages.SendSetTeamTo(s, game.teamB.Id, messages.SetTeam{Team: uint8(game.teamB.TeamId)})
 
-		curTeam = teamA
+		game.curTeam = game.teamA
 	}
 }
 
-func OnDisConn(s *server.Server, connId uint32) {
+// OnRoomLeave frees the seat of a client that left its game, the game is
+// closed once both players are gone.
+func OnRoomLeave(s *server.Server, room string, connId uint32) {
 	mu.Lock()
-	if teamA.Id == connId {
-		teamA = nil
-	} else if teamB.Id == connId {
-		teamB = nil
+	defer mu.Unlock()
+	game, ok := games[room]
+	if !ok {
+		return
+	}
+	delete(players, connId)
+
+	game.mu.Lock()
+	if game.teamA != nil && game.teamA.Id == connId {
+		game.teamA = nil
+	} else if game.teamB != nil && game.teamB.Id == connId {
+		game.teamB = nil
+	}
+	game.curTeam = nil
+	empty := game.teamA == nil && game.teamB == nil
+	game.mu.Unlock()
+
+	if empty {
+		delete(games, room)
+		s.DeleteRoom(room)
 	}
-	mu.Unlock()
 }
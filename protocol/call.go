@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCallAborted is returned by calls that were waiting for their reply when
+// the connection was lost.
+var ErrCallAborted = errors.New("connection lost before the reply arrived")
+
+// RemoteError is the error a handler returned to the peer that called it.
+type RemoteError struct {
+	HandlerId uint32
+	Message   string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("handler %d: %s", e.HandlerId, e.Message)
+}
+
+// Call asks the peer to run a handler and reply with its result.
+type Call struct {
+	Id        uint32
+	HandlerId uint32
+	Data      []byte
+}
+
+func (c Call) Marshal() []byte {
+	data := make([]byte, 8, 8+len(c.Data))
+	binary.BigEndian.PutUint32(data[:4], c.Id)
+	binary.BigEndian.PutUint32(data[4:], c.HandlerId)
+	return append(data, c.Data...)
+}
+
+func (c *Call) Unmarshal(data []byte) error {
+	if len(data) < 8 {
+		return &ProtocolError{errors.New("malformed call")}
+	}
+	c.Id = binary.BigEndian.Uint32(data[:4])
+	c.HandlerId = binary.BigEndian.Uint32(data[4:8])
+	c.Data = data[8:]
+	return nil
+}
+
+// Reply answers the Call with the same Id. When Err is set the handler
+// failed and Data is empty.
+type Reply struct {
+	Id        uint32
+	HandlerId uint32
+	Data      []byte
+	Err       string
+}
+
+// NewReply builds the reply to call from what its handler returned.
+func NewReply(call Call, data []byte, err error) Reply {
+	r := Reply{Id: call.Id, HandlerId: call.HandlerId, Data: data}
+	if err != nil {
+		r.Data = nil
+		r.Err = err.Error()
+		if r.Err == "" {
+			r.Err = "unknown error"
+		}
+	}
+	return r
+}
+
+// Fit replaces a reply too big for a frame of maxSize bytes with an error,
+// so the caller still gets an answer.
+func (r Reply) Fit(maxSize uint32) Reply {
+	if r.Err == "" && uint64(9+len(r.Data)) > uint64(maxSize) {
+		r.Err = fmt.Sprintf("%v: reply of %d bytes, max is %d", ErrFrameTooLarge, len(r.Data), maxSize)
+		r.Data = nil
+	}
+	return r
+}
+
+func (r Reply) Marshal() []byte {
+	body := r.Data
+	failed := byte(0)
+	if r.Err != "" {
+		body = []byte(r.Err)
+		failed = 1
+	}
+
+	data := make([]byte, 9, 9+len(body))
+	binary.BigEndian.PutUint32(data[:4], r.Id)
+	binary.BigEndian.PutUint32(data[4:8], r.HandlerId)
+	data[8] = failed
+	return append(data, body...)
+}
+
+func (r *Reply) Unmarshal(data []byte) error {
+	if len(data) < 9 || data[8] > 1 {
+		return &ProtocolError{errors.New("malformed reply")}
+	}
+	r.Id = binary.BigEndian.Uint32(data[:4])
+	r.HandlerId = binary.BigEndian.Uint32(data[4:8])
+	r.Data, r.Err = nil, ""
+	if data[8] == 1 {
+		r.Err = string(data[9:])
+	} else {
+		r.Data = data[9:]
+	}
+	return nil
+}
+
+// Calls keeps track of the calls made over a connection that wait for
+// their reply. The zero value is ready to use.
+type Calls struct {
+	mu      sync.Mutex
+	next    uint32
+	pending map[uint32]chan Reply
+	aborted bool
+}
+
+// Do sends a call to handlerId with send and waits for the reply or for
+// ctx to be done. A handler error comes back as a *RemoteError.
+func (cs *Calls) Do(ctx context.Context, handlerId uint32, data []byte, send func(call []byte) error) ([]byte, error) {
+	replies := make(chan Reply, 1)
+	cs.mu.Lock()
+	if cs.aborted {
+		cs.mu.Unlock()
+		return nil, ErrCallAborted
+	}
+	if cs.pending == nil {
+		cs.pending = make(map[uint32]chan Reply)
+	}
+	cs.next++
+	id := cs.next
+	cs.pending[id] = replies
+	cs.mu.Unlock()
+	defer cs.forget(id)
+
+	if err := send(Call{Id: id, HandlerId: handlerId, Data: data}.Marshal()); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r, ok := <-replies:
+		if !ok {
+			return nil, ErrCallAborted
+		}
+		if r.Err != "" {
+			return nil, &RemoteError{HandlerId: r.HandlerId, Message: r.Err}
+		}
+		return r.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Finish hands a reply to the call waiting for it. Replies nobody waits for
+// anymore, because the call timed out, are dropped.
+func (cs *Calls) Finish(r Reply) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if replies, ok := cs.pending[r.Id]; ok {
+		replies <- r
+		delete(cs.pending, r.Id)
+	}
+}
+
+// Abort fails every call still waiting, and every later one, with
+// ErrCallAborted. It is called once no more replies can arrive.
+func (cs *Calls) Abort() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.aborted = true
+	for id, replies := range cs.pending {
+		close(replies)
+		delete(cs.pending, id)
+	}
+}
+
+func (cs *Calls) forget(id uint32) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.pending, id)
+}
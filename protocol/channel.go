@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Channel selects how a message travels.
+type Channel uint8
+
+const (
+	// Safe sends over tcp: reliable and ordered, but one lost packet holds
+	// back everything sent after it.
+	Safe Channel = iota
+	// Fast sends a plain datagram that can be lost or arrive out of order.
+	Fast
+	// Sequenced is Fast, but a message older than one already delivered
+	// from the same channel is dropped instead of arriving late.
+	Sequenced
+	// Reliable sends datagrams that are resent until acknowledged, each
+	// message is delivered exactly once but in any order.
+	Reliable
+	// ReliableOrdered is Reliable, and messages are delivered in the order
+	// they were sent.
+	ReliableOrdered
+
+	numChannels
+)
+
+func (ch Channel) String() string {
+	switch ch {
+	case Safe:
+		return "safe"
+	case Fast:
+		return "fast"
+	case Sequenced:
+		return "sequenced"
+	case Reliable:
+		return "reliable"
+	case ReliableOrdered:
+		return "reliable-ordered"
+	}
+	return fmt.Sprintf("channel(%d)", uint8(ch))
+}
+
+// sequenced reports whether datagrams on ch carry a channel sequence number.
+func (ch Channel) sequenced() bool {
+	return ch == Sequenced || ch == Reliable || ch == ReliableOrdered
+}
+
+func (ch Channel) reliable() bool {
+	return ch == Reliable || ch == ReliableOrdered
+}
+
+const (
+	// reliableWindow is how many reliable messages per channel can wait
+	// for their ack, and how far ahead of the next expected message the
+	// receiver keeps messages around.
+	reliableWindow = 1024
+
+	resendInterval = 20 * time.Millisecond
+	minRTO         = 50 * time.Millisecond
+	maxRTO         = 2 * time.Second
+	defaultRTO     = 200 * time.Millisecond
+
+	// ackSize is the size of an ack payload: the channel, the cumulative
+	// ack, the highest sequence number received and the 32 before it.
+	ackSize = 1 + 4 + 4 + 4
+)
+
+var ErrWindowFull = errors.New("too many unacknowledged reliable messages")
+
+// Message is a message received on the fast channel.
+type Message struct {
+	HandlerId uint32
+	Data      []byte
+	// Borrowed is set when Data points into the packet given to Open and
+	// is only valid as long as that packet is.
+	Borrowed bool
+}
+
+type pending struct {
+	header header
+	data   []byte
+	sentAt time.Time
+	tries  int
+}
+
+type sendState struct {
+	next    uint32
+	pending map[uint32]*pending
+}
+
+type recvState struct {
+	// last is the newest sequence number delivered on Sequenced, and for
+	// the reliable channels every sequence number up to last was received.
+	last uint32
+	// highest and bits remember what was received for the acks, bit i is
+	// highest-1-i.
+	highest uint32
+	bits    uint32
+	// seen holds what Reliable received above last.
+	seen map[uint32]struct{}
+	// held holds what ReliableOrdered received above last+1.
+	held map[uint32]Message
+}
+
+// track records seq for the next ack. A seq too far ahead to be kept is left
+// out, so the peer resends it instead of taking it as delivered.
+func (r *recvState) track(seq uint32) {
+	if seq > r.last && seq-r.last > reliableWindow {
+		return
+	}
+	switch {
+	case seq > r.highest:
+		shift := seq - r.highest
+		if shift > 32 {
+			r.bits = 0
+		} else {
+			r.bits = r.bits<<shift | 1<<(shift-1)
+		}
+		r.highest = seq
+	case seq < r.highest:
+		if offset := r.highest - seq; offset <= 32 {
+			r.bits |= 1 << (offset - 1)
+		}
+	}
+}
+
+func (r *recvState) ack(ch Channel) []byte {
+	data := []byte{byte(ch)}
+	data = binary.BigEndian.AppendUint32(data, r.last+1)
+	data = binary.BigEndian.AppendUint32(data, r.highest)
+	return binary.BigEndian.AppendUint32(data, r.bits)
+}
+
+// room is how many messages receiveReliable hands out for seq, now or
+// later. A message held back on ReliableOrdered needs room for everything
+// held with it, as the message filling the gap releases them all at once.
+func (r *recvState) room(ch Channel, seq uint32) int {
+	if seq <= r.last || seq-r.last > reliableWindow {
+		return 0
+	}
+	if ch == Reliable {
+		if _, ok := r.seen[seq]; ok {
+			return 0
+		}
+		return 1
+	}
+	if _, ok := r.held[seq]; ok {
+		return 0
+	}
+	if seq != r.last+1 {
+		return len(r.held) + 2
+	}
+	n := 1
+	for next := seq + 1; ; next++ {
+		if _, ok := r.held[next]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// receiveReliable returns the messages that d makes deliverable, in order.
+func (r *recvState) receiveReliable(ch Channel, seq uint32, m Message) []Message {
+	if seq <= r.last || seq-r.last > reliableWindow {
+		// a resend of something we have, or too far ahead to keep
+		return nil
+	}
+
+	if ch == Reliable {
+		if _, ok := r.seen[seq]; ok {
+			return nil
+		}
+		r.seen[seq] = struct{}{}
+		for {
+			if _, ok := r.seen[r.last+1]; !ok {
+				break
+			}
+			delete(r.seen, r.last+1)
+			r.last++
+		}
+		return []Message{m}
+	}
+
+	if seq != r.last+1 {
+		if _, ok := r.held[seq]; !ok {
+			if m.Borrowed {
+				m.Data = append([]byte(nil), m.Data...)
+				m.Borrowed = false
+			}
+			r.held[seq] = m
+		}
+		return nil
+	}
+
+	out := []Message{m}
+	r.last++
+	for {
+		next, ok := r.held[r.last+1]
+		if !ok {
+			break
+		}
+		delete(r.held, r.last+1)
+		out = append(out, next)
+		r.last++
+	}
+	return out
+}
@@ -0,0 +1,300 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// wire collects the datagrams a link writes.
+type wire struct {
+	packets [][]byte
+}
+
+func (w *wire) write(packet []byte) error {
+	w.packets = append(w.packets, append([]byte(nil), packet...))
+	return nil
+}
+
+func (w *wire) take() [][]byte {
+	packets := w.packets
+	w.packets = nil
+	return packets
+}
+
+// newPair returns a client and a server link talking to each other through
+// the returned wires, what a writes ends up on aOut.
+func newPair(t *testing.T) (a, b *Link, aOut, bOut *wire) {
+	t.Helper()
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b = NewLink(7, secret, false), NewLink(7, secret, true)
+	aOut, bOut = new(wire), new(wire)
+	a.SetWriter(aOut.write)
+	b.SetWriter(bOut.write)
+	return a, b, aOut, bOut
+}
+
+// deliver hands packets to l and returns the index in every message it
+// delivered.
+func deliver(l *Link, packets [][]byte) []uint32 {
+	var got []uint32
+	for _, packet := range packets {
+		d, err := l.Open(packet)
+		if err != nil {
+			continue
+		}
+		for _, m := range l.Receive(d) {
+			got = append(got, binary.BigEndian.Uint32(m.Data))
+		}
+	}
+	return got
+}
+
+func TestTrack(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		seqs        []uint32
+		wantHighest uint32
+		wantBits    uint32
+	}{
+		// 0 is never sent, it counts as received
+		{"in order", []uint32{1, 2, 3}, 3, 0b111},
+		{"loss", []uint32{1, 3}, 3, 0b110},
+		{"reordered", []uint32{3, 1, 2}, 3, 0b111},
+		{"duplicates", []uint32{1, 2, 2, 1}, 2, 0b11},
+		{"gap of 32", []uint32{1, 33}, 33, 1 << 31},
+		{"gap past the bitfield", []uint32{1, 34}, 34, 0},
+		{"too old for the bitfield", []uint32{40, 1}, 40, 0},
+		{"past the window", []uint32{1, reliableWindow + 1}, 1, 0b1},
+		{"end of the window", []uint32{reliableWindow}, reliableWindow, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var r recvState
+			for _, seq := range tt.seqs {
+				r.track(seq)
+			}
+			if r.highest != tt.wantHighest || r.bits != tt.wantBits {
+				t.Errorf("highest %d bits %b, want %d and %b", r.highest, r.bits, tt.wantHighest, tt.wantBits)
+			}
+		})
+	}
+}
+
+func TestAcked(t *testing.T) {
+	ack := func(ch Channel, cumulative, highest, bits uint32) []byte {
+		r := recvState{last: cumulative - 1, highest: highest, bits: bits}
+		return r.ack(ch)
+	}
+	for _, tt := range []struct {
+		name string
+		ack  []byte
+		// want are the sequence numbers still waiting for an ack out of
+		// 1 to 40
+		want []uint32
+	}{
+		{"cumulative", ack(ReliableOrdered, 38, 37, 0), []uint32{38, 39, 40}},
+		{"highest", ack(ReliableOrdered, 1, 40, 0), seqs(1, 39)},
+		{"bitfield", ack(ReliableOrdered, 1, 10, 0b101), append(append(seqs(1, 6), 8), seqs(11, 40)...)},
+		{"oldest bit", ack(ReliableOrdered, 1, 40, 1<<31), append(seqs(1, 7), seqs(9, 39)...)},
+		{"everything", ack(ReliableOrdered, 41, 40, 0), nil},
+		{"other channel", ack(Reliable, 41, 40, 0), seqs(1, 40)},
+		{"unreliable channel", ack(Fast, 41, 40, 0), seqs(1, 40)},
+		{"short", ack(ReliableOrdered, 41, 40, 0)[:ackSize-1], seqs(1, 40)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, _, _ := newPair(t)
+			for range 40 {
+				if err := a.Send(ReliableOrdered, 1, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a.acked(tt.ack)
+
+			pending := a.send[ReliableOrdered].pending
+			if len(pending) != len(tt.want) {
+				t.Errorf("%d messages pending, want %d", len(pending), len(tt.want))
+			}
+			for _, seq := range tt.want {
+				if _, ok := pending[seq]; !ok {
+					t.Errorf("%d was acked", seq)
+				}
+			}
+		})
+	}
+}
+
+// seqs returns the sequence numbers from first to last.
+func seqs(first, last uint32) []uint32 {
+	var out []uint32
+	for seq := first; seq <= last; seq++ {
+		out = append(out, seq)
+	}
+	return out
+}
+
+func TestReceiveReliable(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ch   Channel
+		seqs []uint32
+		want []uint32
+		// wantLast is where the receiver is after seqs
+		wantLast uint32
+	}{
+		{"in order", ReliableOrdered, []uint32{1, 2, 3}, []uint32{1, 2, 3}, 3},
+		{"held until the gap fills", ReliableOrdered, []uint32{2, 3, 1}, []uint32{1, 2, 3}, 3},
+		{"held past a gap", ReliableOrdered, []uint32{1, 3, 4}, []uint32{1}, 1},
+		{"duplicates", ReliableOrdered, []uint32{1, 1, 3, 3, 2, 2}, []uint32{1, 2, 3}, 3},
+		{"past the window", ReliableOrdered, []uint32{reliableWindow + 1, 1}, []uint32{1}, 1},
+		{"end of the window", ReliableOrdered, append(seqs(2, reliableWindow), 1), seqs(1, reliableWindow), reliableWindow},
+		{"unordered", Reliable, []uint32{2, 3, 1}, []uint32{2, 3, 1}, 3},
+		{"unordered duplicates", Reliable, []uint32{2, 2, 1, 1, 2}, []uint32{2, 1}, 2},
+		{"unordered past the window", Reliable, []uint32{reliableWindow + 1, 1}, []uint32{1}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := recvState{seen: make(map[uint32]struct{}), held: make(map[uint32]Message)}
+			var got []uint32
+			for _, seq := range tt.seqs {
+				data := binary.BigEndian.AppendUint32(nil, seq)
+				for _, m := range r.receiveReliable(tt.ch, seq, Message{Data: data, Borrowed: true}) {
+					got = append(got, binary.BigEndian.Uint32(m.Data))
+				}
+				// a held message must not keep pointing at the packet
+				clear(data)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("delivered %v, want %v", got, tt.want)
+			}
+			if r.last != tt.wantLast {
+				t.Errorf("last is %d, want %d", r.last, tt.wantLast)
+			}
+		})
+	}
+}
+
+// Every reliable message arrives exactly once, and in order on
+// ReliableOrdered, however the datagrams and their acks are mangled on the
+// way.
+func TestReliableDelivery(t *testing.T) {
+	const count = 300
+	for _, ch := range []Channel{Reliable, ReliableOrdered} {
+		for _, tt := range []struct {
+			name    string
+			loss    float64
+			dup     float64
+			reorder bool
+		}{
+			{"clean", 0, 0, false},
+			{"loss", 0.3, 0, false},
+			{"duplicates", 0, 0.3, false},
+			{"reordered", 0, 0, true},
+			{"everything", 0.3, 0.3, true},
+		} {
+			t.Run(ch.String()+"/"+tt.name, func(t *testing.T) {
+				rng := rand.New(rand.NewPCG(1, 2))
+				mangle := func(packets [][]byte) [][]byte {
+					var out [][]byte
+					for _, packet := range packets {
+						if rng.Float64() < tt.loss {
+							continue
+						}
+						out = append(out, packet)
+						if rng.Float64() < tt.dup {
+							out = append(out, packet)
+						}
+					}
+					if tt.reorder {
+						rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+					}
+					return out
+				}
+
+				a, b, aOut, bOut := newPair(t)
+				for i := range uint32(count) {
+					if err := a.Send(ch, 1, binary.BigEndian.AppendUint32(nil, i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				var got []uint32
+				now := time.Now()
+				for round := 0; round < 100 && len(a.send[ch].pending) > 0; round++ {
+					if round > 50 {
+						// let the last acks through
+						tt.loss, tt.dup = 0, 0
+					}
+					got = append(got, deliver(b, mangle(aOut.take()))...)
+					deliver(a, mangle(bOut.take()))
+					now = now.Add(maxRTO)
+					a.retransmit(now)
+				}
+
+				if n := len(a.send[ch].pending); n > 0 {
+					t.Errorf("%d messages never acked", n)
+				}
+				if len(got) != count {
+					t.Fatalf("got %d of %d messages", len(got), count)
+				}
+				seen := make(map[uint32]bool)
+				for i, n := range got {
+					if seen[n] {
+						t.Fatalf("message %d arrived twice", n)
+					}
+					seen[n] = true
+					if ch == ReliableOrdered && n != uint32(i) {
+						t.Fatalf("message %d arrived as %d", i, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+// A message sent further ahead than the receiver keeps is resent until it
+// fits, rather than acked and lost.
+func TestReliableWindowOverflow(t *testing.T) {
+	const count = reliableWindow + 100
+	a, b, aOut, bOut := newPair(t)
+
+	// the first message is lost, everything after it waits for it
+	if err := a.Send(ReliableOrdered, 1, binary.BigEndian.AppendUint32(nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	aOut.take()
+	var got []uint32
+	for i := uint32(1); i < count; i++ {
+		if err := a.Send(ReliableOrdered, 1, binary.BigEndian.AppendUint32(nil, i)); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, deliver(b, aOut.take())...)
+		deliver(a, bOut.take())
+	}
+	if len(got) != 0 {
+		t.Fatalf("delivered %d messages before the first one", len(got))
+	}
+	// the lost one and the ones past the window
+	if n, want := len(a.send[ReliableOrdered].pending), count-reliableWindow+1; n != want {
+		t.Errorf("%d messages pending, want %d", n, want)
+	}
+
+	now := time.Now()
+	for round := 0; round < 10 && len(a.send[ReliableOrdered].pending) > 0; round++ {
+		now = now.Add(maxRTO)
+		a.retransmit(now)
+		got = append(got, deliver(b, aOut.take())...)
+		deliver(a, bOut.take())
+	}
+	if len(got) != count {
+		t.Fatalf("got %d of %d messages", len(got), count)
+	}
+	for i, n := range got {
+		if n != uint32(i) {
+			t.Fatalf("message %d arrived as %d", i, n)
+		}
+	}
+}
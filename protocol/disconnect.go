@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DisconnectCode tells why a connection ended.
+type DisconnectCode uint8
+
+const (
+	// ConnectionLost means the connection broke without a close frame.
+	ConnectionLost DisconnectCode = iota
+	// ClientQuit means the client left on its own.
+	ClientQuit
+	// Kicked means the server dropped the client.
+	Kicked
+	// TimedOut means the peer stayed silent for longer than the idle
+	// timeout.
+	TimedOut
+	// ProtocolViolation means the peer broke the wire protocol.
+	ProtocolViolation
+	// ServerShutdown means the server is shutting down.
+	ServerShutdown
+	// Banned means the client is banned from the server.
+	Banned
+	// ServerFull means the server had no room for another client.
+	ServerFull
+	// Rejected means the server turned the client away when it connected.
+	Rejected
+	// Unauthorized means the server did not accept the credentials of the
+	// client.
+	Unauthorized
+)
+
+func (code DisconnectCode) String() string {
+	switch code {
+	case ConnectionLost:
+		return "connection lost"
+	case ClientQuit:
+		return "client quit"
+	case Kicked:
+		return "kicked"
+	case TimedOut:
+		return "timed out"
+	case ProtocolViolation:
+		return "protocol violation"
+	case ServerShutdown:
+		return "server shutdown"
+	case Banned:
+		return "banned"
+	case ServerFull:
+		return "server full"
+	case Rejected:
+		return "rejected"
+	case Unauthorized:
+		return "unauthorized"
+	}
+	return fmt.Sprintf("disconnect code %d", uint8(code))
+}
+
+// DisconnectReason is why a connection ended, it is sent to the peer in a
+// HandlerClose frame. Message is free text, like why a client was kicked.
+type DisconnectReason struct {
+	Code    DisconnectCode
+	Message string
+}
+
+func (r DisconnectReason) String() string {
+	if r.Message == "" {
+		return r.Code.String()
+	}
+	return r.Code.String() + ": " + r.Message
+}
+
+// Retry reports whether the connection ended for a reason worth
+// reconnecting after, rather than on purpose.
+func (r DisconnectReason) Retry() bool {
+	switch r.Code {
+	case ConnectionLost, TimedOut, ServerShutdown, ServerFull:
+		return true
+	}
+	return false
+}
+
+func (r DisconnectReason) Marshal() []byte {
+	return append([]byte{byte(r.Code)}, r.Message...)
+}
+
+func (r *DisconnectReason) Unmarshal(data []byte) error {
+	if len(data) < 1 {
+		return &ProtocolError{errors.New("malformed close")}
+	}
+	r.Code = DisconnectCode(data[0])
+	r.Message = string(data[1:])
+	return nil
+}
+
+// ReadReason tells why reading from a connection failed with err.
+func ReadReason(err error) DisconnectReason {
+	var protoErr *ProtocolError
+	switch {
+	case errors.As(err, &protoErr):
+		return DisconnectReason{Code: ProtocolViolation, Message: protoErr.Error()}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return DisconnectReason{Code: TimedOut}
+	}
+	return DisconnectReason{Code: ConnectionLost}
+}
@@ -0,0 +1,18 @@
+package protocol
+
+import "net"
+
+// SetDontFragment keeps the datagrams sent on conn from being fragmented,
+// so an MTU probe bigger than the path is lost instead of arriving in
+// pieces and passing for one that fits.
+func SetDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) { sockErr = dontFragment(fd) }); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,18 @@
+package protocol
+
+import "syscall"
+
+// from netinet/in.h and netinet6/in6.h, syscall doesn't have them
+const (
+	ipDontFrag   = 28
+	ipv6DontFrag = 62
+)
+
+func dontFragment(fd uintptr) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipDontFrag, 1)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
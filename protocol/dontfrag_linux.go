@@ -0,0 +1,15 @@
+package protocol
+
+import "syscall"
+
+// dontFragment sets the probe mode, which sets the don't fragment bit
+// without the kernel capping datagrams at the path MTU it has cached.
+// Either option is fine, a socket only speaks one family.
+func dontFragment(fd uintptr) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
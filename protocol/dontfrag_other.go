@@ -0,0 +1,9 @@
+//go:build !linux && !windows && !darwin
+
+package protocol
+
+import "errors"
+
+func dontFragment(fd uintptr) error {
+	return errors.ErrUnsupported
+}
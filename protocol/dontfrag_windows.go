@@ -0,0 +1,18 @@
+package protocol
+
+import "syscall"
+
+// from ws2ipdef.h, syscall doesn't have them
+const (
+	ipDontFragment = 14
+	ipv6DontFrag   = 14
+)
+
+func dontFragment(fd uintptr) error {
+	err4 := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipDontFragment, 1)
+	err6 := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is a panic in a handler, recovered and turned into an error.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+// NewPanicError wraps the value of a recovered panic, it has to be called
+// from the deferred function that recovered it to capture the stack.
+func NewPanicError(v any) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// ErrorPolicy decides what happens after a handler returned an error or
+// panicked.
+type ErrorPolicy int
+
+const (
+	// LogErrors logs the error to the Logger and carries on.
+	LogErrors ErrorPolicy = iota
+	// IgnoreErrors carries on silently.
+	IgnoreErrors
+	// DisconnectOnError drops the connection the message came from.
+	DisconnectOnError
+)
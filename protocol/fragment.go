@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// fragmentFlag is set on the channel byte of a datagram carrying a
+	// fragment of a message.
+	fragmentFlag = 0x80
+	// fragmentHeaderSize is the size of the fragment id, index and count.
+	fragmentHeaderSize = 4 + 2 + 2
+	maxFragments       = 1<<16 - 1
+
+	// reassemblyTimeout is how long the fragments of a message wait for
+	// the rest of it.
+	reassemblyTimeout = 2 * time.Second
+	// maxReassemblyBytes caps the memory one link spends on messages that
+	// are not complete yet.
+	maxReassemblyBytes = 4 << 20
+	maxPartials        = 64
+)
+
+// header is everything in a datagram besides the payload.
+type header struct {
+	handlerId uint32
+	ch        Channel
+	seq       uint32
+
+	fragmented bool
+	fragId     uint32
+	index      uint16
+	count      uint16
+}
+
+func (h header) size() int {
+	size := 4 + 1
+	if h.ch.sequenced() {
+		size += 4
+	}
+	if h.fragmented {
+		size += fragmentHeaderSize
+	}
+	return size
+}
+
+func (h header) append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, h.handlerId)
+	ch := byte(h.ch)
+	if h.fragmented {
+		ch |= fragmentFlag
+	}
+	dst = append(dst, ch)
+	if h.ch.sequenced() {
+		dst = binary.BigEndian.AppendUint32(dst, h.seq)
+	}
+	if h.fragmented {
+		dst = binary.BigEndian.AppendUint32(dst, h.fragId)
+		dst = binary.BigEndian.AppendUint16(dst, h.index)
+		dst = binary.BigEndian.AppendUint16(dst, h.count)
+	}
+	return dst
+}
+
+// parseHeader splits an opened datagram body into its header and payload.
+func parseHeader(body []byte) (header, []byte, error) {
+	if len(body) < 5 {
+		return header{}, nil, ErrShortDatagram
+	}
+
+	h := header{
+		handlerId:  binary.BigEndian.Uint32(body[:4]),
+		ch:         Channel(body[4] &^ fragmentFlag),
+		fragmented: body[4]&fragmentFlag != 0,
+	}
+	if h.ch == Safe || h.ch >= numChannels {
+		return header{}, nil, &ProtocolError{fmt.Errorf("unknown channel %d", body[4])}
+	}
+	if len(body) < h.size() {
+		return header{}, nil, ErrShortDatagram
+	}
+
+	rest := body[5:]
+	if h.ch.sequenced() {
+		h.seq = binary.BigEndian.Uint32(rest[:4])
+		rest = rest[4:]
+	}
+	if h.fragmented {
+		h.fragId = binary.BigEndian.Uint32(rest[:4])
+		h.index = binary.BigEndian.Uint16(rest[4:6])
+		h.count = binary.BigEndian.Uint16(rest[6:8])
+		rest = rest[8:]
+		if h.count == 0 || h.index >= h.count {
+			return header{}, nil, &ProtocolError{fmt.Errorf("fragment %d of %d", h.index, h.count)}
+		}
+	}
+	return h, rest, nil
+}
+
+// partial is a message of which only some fragments arrived.
+type partial struct {
+	header  header
+	parts   map[uint16][]byte
+	size    int
+	started time.Time
+}
+
+// reassembler puts fragmented messages back together.
+type reassembler struct {
+	partials map[uint32]*partial
+	size     int
+}
+
+// add stores one fragment and returns the whole message once every fragment
+// of it arrived. Fragments that would take more memory than allowed are
+// dropped, the sender resends them if they were reliable.
+func (r *reassembler) add(h header, data []byte, maxMessageSize uint32, now time.Time) ([]byte, bool) {
+	p, ok := r.partials[h.fragId]
+	if !ok {
+		if len(r.partials) >= maxPartials {
+			return nil, false
+		}
+		p = &partial{header: h, parts: make(map[uint16][]byte), started: now}
+		r.partials[h.fragId] = p
+	}
+	if p.header.count != h.count || p.header.handlerId != h.handlerId || p.header.ch != h.ch || p.header.seq != h.seq {
+		return nil, false
+	}
+	if _, ok := p.parts[h.index]; ok {
+		return nil, false
+	}
+	if uint64(p.size+len(data)) > uint64(maxMessageSize) || r.size+len(data) > maxReassemblyBytes {
+		r.drop(h.fragId)
+		return nil, false
+	}
+
+	p.parts[h.index] = append([]byte(nil), data...)
+	p.size += len(data)
+	r.size += len(data)
+	if len(p.parts) < int(p.header.count) {
+		return nil, false
+	}
+
+	whole := make([]byte, 0, p.size)
+	for i := range p.header.count {
+		whole = append(whole, p.parts[i]...)
+	}
+	r.drop(h.fragId)
+	return whole, true
+}
+
+func (r *reassembler) drop(fragId uint32) {
+	if p, ok := r.partials[fragId]; ok {
+		r.size -= p.size
+		delete(r.partials, fragId)
+	}
+}
+
+// expire drops the messages that waited too long for their last fragments.
+func (r *reassembler) expire(now time.Time) {
+	for fragId, p := range r.partials {
+		if now.Sub(p.started) > reassemblyTimeout {
+			r.drop(fragId)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReassembler(t *testing.T) {
+	big := maxReassemblyBytes / 8
+
+	for _, tt := range []struct {
+		name           string
+		fragments      []fragment
+		maxMessageSize uint32
+		// want is how many messages came out whole
+		want         int
+		wantPartials int
+	}{
+		{
+			name:      "in order",
+			fragments: []fragment{{1, 0, 3, 10}, {1, 1, 3, 10}, {1, 2, 3, 10}},
+			want:      1,
+		},
+		{
+			name:      "reordered",
+			fragments: []fragment{{1, 2, 3, 10}, {1, 0, 3, 10}, {1, 1, 3, 10}},
+			want:      1,
+		},
+		{
+			name:         "lost",
+			fragments:    []fragment{{1, 0, 3, 10}, {1, 2, 3, 10}},
+			wantPartials: 1,
+		},
+		{
+			name:         "duplicates",
+			fragments:    []fragment{{1, 0, 3, 10}, {1, 0, 3, 10}, {1, 1, 3, 10}},
+			wantPartials: 1,
+		},
+		{
+			name:         "count changed",
+			fragments:    []fragment{{1, 0, 2, 10}, {1, 1, 3, 10}},
+			wantPartials: 1,
+		},
+		{
+			name:      "interleaved",
+			fragments: []fragment{{1, 0, 2, 10}, {2, 1, 2, 10}, {2, 0, 2, 10}, {1, 1, 2, 10}},
+			want:      2,
+		},
+		{
+			name:           "over the message size",
+			fragments:      []fragment{{1, 0, 3, 10}, {1, 1, 3, 10}, {1, 2, 3, 10}},
+			maxMessageSize: 25,
+		},
+		{
+			name: "over the memory cap",
+			fragments: []fragment{
+				{1, 0, 2, big}, {2, 0, 2, big}, {3, 0, 2, big}, {4, 0, 2, big},
+				{5, 0, 2, big}, {6, 0, 2, big}, {7, 0, 2, big}, {8, 0, 2, big},
+				// no memory left, this drops the message it belongs to
+				{1, 1, 2, 1},
+			},
+			wantPartials: 7,
+		},
+		{
+			name: "memory given back",
+			fragments: []fragment{
+				{1, 0, 2, big}, {2, 0, 2, big}, {3, 0, 2, big}, {4, 0, 2, big},
+				{5, 0, 2, big}, {6, 0, 2, big}, {7, 0, 2, big}, {8, 0, 2, big},
+				{1, 1, 2, 1},
+				{9, 0, 1, big},
+			},
+			want:         1,
+			wantPartials: 7,
+		},
+		{
+			name:         "too many partials",
+			fragments:    firsts(maxPartials + 1),
+			wantPartials: maxPartials,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.maxMessageSize == 0 {
+				tt.maxMessageSize = maxReassemblyBytes
+			}
+			r := reassembler{partials: make(map[uint32]*partial)}
+			now := time.Now()
+			got := 0
+			for _, f := range tt.fragments {
+				h := header{handlerId: 1, ch: Fast, fragmented: true, fragId: f.fragId, index: f.index, count: f.count}
+				data := bytes.Repeat([]byte{byte(f.index)}, f.size)
+				whole, ok := r.add(h, data, tt.maxMessageSize, now)
+				if !ok {
+					continue
+				}
+				got++
+				for i, b := range whole {
+					if want := byte(i / f.size); b != want {
+						t.Fatalf("byte %d of message %d is from fragment %d, want %d", i, f.fragId, b, want)
+					}
+				}
+			}
+
+			if got != tt.want {
+				t.Errorf("%d messages whole, want %d", got, tt.want)
+			}
+			if len(r.partials) != tt.wantPartials {
+				t.Errorf("%d partials, want %d", len(r.partials), tt.wantPartials)
+			}
+			size := 0
+			for _, p := range r.partials {
+				size += p.size
+			}
+			if r.size != size {
+				t.Errorf("size is %d, the partials hold %d", r.size, size)
+			}
+
+			r.expire(now.Add(reassemblyTimeout + time.Second))
+			if len(r.partials) != 0 || r.size != 0 {
+				t.Errorf("%d partials of %d bytes left after they expired", len(r.partials), r.size)
+			}
+		})
+	}
+}
+
+// fragment is part index of a message of count parts, each holding size
+// bytes of it.
+type fragment struct {
+	fragId uint32
+	index  uint16
+	count  uint16
+	size   int
+}
+
+// firsts returns the first of two fragments of n messages.
+func firsts(n int) []fragment {
+	out := make([]fragment, n)
+	for i := range out {
+		out[i] = fragment{fragId: uint32(i + 1), count: 2, size: 10}
+	}
+	return out
+}
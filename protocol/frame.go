@@ -0,0 +1,77 @@
+// Package protocol holds the wire format shared by the flera server and
+// client packages.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameHeaderSize is the size of the handler id and payload size that
+// prefix every frame on the safe (tcp) channel.
+const FrameHeaderSize = 8
+
+// DefaultMaxMessageSize is the largest frame payload accepted by default.
+const DefaultMaxMessageSize uint32 = 1 << 20
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ProtocolError is returned when the peer broke the wire protocol. The
+// stream can not be trusted after it, so the connection should be closed.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error: %v", e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// AppendFrame appends a frame carrying data for handlerId to dst.
+func AppendFrame(dst []byte, handlerId uint32, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, handlerId)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	return append(dst, data...)
+}
+
+// WriteFrame writes a frame to w with a single call to Write, which keeps
+// frames whole when several goroutines share a net.Conn.
+func WriteFrame(w io.Writer, handlerId uint32, data []byte, maxSize uint32) error {
+	if uint64(len(data)) > uint64(maxSize) {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrFrameTooLarge, len(data), maxSize)
+	}
+
+	packet := AppendFrame(make([]byte, 0, FrameHeaderSize+len(data)), handlerId, data)
+	_, err := w.Write(packet)
+	return err
+}
+
+// ReadFrame reads one whole frame from r. A frame announcing more than
+// maxSize bytes is rejected with a *ProtocolError before anything is
+// allocated for it.
+func ReadFrame(r io.Reader, maxSize uint32) (uint32, []byte, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	handlerId := binary.BigEndian.Uint32(header[:4])
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > maxSize {
+		return 0, nil, &ProtocolError{fmt.Errorf("%w: handler %d sent %d bytes, max is %d", ErrFrameTooLarge, handlerId, size, maxSize)}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return handlerId, data, nil
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Handler ids from ReservedHandlerIds and up are used by flera itself and
+// can't be registered by applications.
+const ReservedHandlerIds uint32 = 0xFFFFFF00
+
+const (
+	// HandlerHello binds the udp address of a client to its connection.
+	HandlerHello uint32 = ^uint32(0) - iota
+	// HandlerWelcome answers the Handshake of a client, it carries the
+	// connection id, the session secret and the resume token.
+	HandlerWelcome
+	// HandlerPing asks the peer to echo the payload back with a
+	// HandlerPong on the same channel.
+	HandlerPing
+	HandlerPong
+	// HandlerAck acknowledges datagrams on the reliable fast channels.
+	HandlerAck
+	// HandlerMTUProbe is a padded datagram used to find the path MTU, the
+	// peer answers with a HandlerMTUAck carrying its size.
+	HandlerMTUProbe
+	HandlerMTUAck
+	// HandlerCall carries a Call over tcp, the peer answers it with a
+	// HandlerReply carrying a Reply.
+	HandlerCall
+	HandlerReply
+	// HandlerHandshake is the first tcp frame a client sends, it carries a
+	// Handshake.
+	HandlerHandshake
+	// HandlerClose is the last tcp frame sent before closing a connection
+	// on purpose, it carries the DisconnectReason. The session of a client
+	// that closed is not kept for resuming.
+	HandlerClose
+)
+
+// SecretSize is the size of the per session secret used to authenticate
+// datagrams on the fast (udp) channel.
+const SecretSize = 32
+
+func IsReserved(handlerId uint32) bool {
+	return handlerId >= ReservedHandlerIds
+}
+
+// NewSecret returns a fresh random session secret.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// TokenSize is the size of the token a client resumes its session with.
+const TokenSize = 32
+
+// NewToken returns a fresh random resume token.
+func NewToken() ([]byte, error) {
+	token := make([]byte, TokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Handshake opens a connection. Token is the resume token of an earlier
+// session to resume, empty for a new one. Credentials are handed to the
+// Authenticate callback of the server.
+type Handshake struct {
+	Token       []byte
+	Credentials []byte
+}
+
+func (h Handshake) Marshal() []byte {
+	data := binary.BigEndian.AppendUint16(nil, uint16(len(h.Token)))
+	data = append(data, h.Token...)
+	return append(data, h.Credentials...)
+}
+
+func (h *Handshake) Unmarshal(data []byte) error {
+	if len(data) < 2 {
+		return &ProtocolError{errors.New("malformed handshake")}
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return &ProtocolError{errors.New("malformed handshake")}
+	}
+	h.Token = append([]byte(nil), data[2:2+size]...)
+	h.Credentials = append([]byte(nil), data[2+size:]...)
+	return nil
+}
+
+// Welcome accepts a Handshake. Resumed tells whether the connection took
+// over the session of the token, Token is the one to resume the new session
+// with and empty when the server doesn't keep sessions.
+type Welcome struct {
+	ConnId  uint32
+	Secret  []byte
+	Resumed bool
+	Token   []byte
+}
+
+func (w Welcome) Marshal() []byte {
+	data := binary.BigEndian.AppendUint32(nil, w.ConnId)
+	data = append(data, w.Secret...)
+	if w.Resumed {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	return append(data, w.Token...)
+}
+
+func (w *Welcome) Unmarshal(data []byte) error {
+	if len(data) < 4+SecretSize+1 || data[4+SecretSize] > 1 {
+		return &ProtocolError{errors.New("malformed welcome")}
+	}
+	w.ConnId = binary.BigEndian.Uint32(data[:4])
+	w.Secret = append([]byte(nil), data[4:4+SecretSize]...)
+	w.Resumed = data[4+SecretSize] == 1
+	w.Token = append([]byte(nil), data[4+SecretSize+1:]...)
+	return nil
+}
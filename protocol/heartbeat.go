@@ -0,0 +1,11 @@
+package protocol
+
+import "time"
+
+const (
+	// DefaultHeartbeatInterval is how often a ping is sent on each channel.
+	DefaultHeartbeatInterval = time.Second
+	// DefaultIdleTimeout is how long a peer can stay silent before it is
+	// considered gone.
+	DefaultIdleTimeout = 10 * time.Second
+)
@@ -0,0 +1,564 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DatagramHeaderSize is the size of the connection id and sequence number
+// that prefix every datagram on the fast (udp) channel.
+const DatagramHeaderSize = 12
+
+// TagSize is the size of the authentication tag that ends every datagram.
+const TagSize = 16
+
+// DatagramOverhead is how many bytes flera adds to a payload on the Fast
+// channel: the header, the handler id, the channel and the tag.
+const DatagramOverhead = DatagramHeaderSize + 4 + 1 + TagSize
+
+// MaxDatagramOverhead is DatagramOverhead plus the channel sequence number
+// of the sequenced and reliable channels and the fragment header.
+const MaxDatagramOverhead = DatagramOverhead + 4 + fragmentHeaderSize
+
+// DefaultPacketSize is the largest payload put in a single datagram by
+// default, bigger messages are split into fragments.
+const DefaultPacketSize = 1024
+
+// tlsExporterLabel is the label used to export the udp keys from a tls
+// connection, see RFC 5705.
+const tlsExporterLabel = "EXPORTER-flera-udp"
+
+var (
+	ErrShortDatagram = errors.New("datagram too short")
+	ErrBadTag        = errors.New("datagram failed authentication")
+	ErrReplay        = errors.New("datagram replayed or too old")
+	ErrNoWriter      = errors.New("link has no writer")
+)
+
+// Link protects the datagrams exchanged with one peer on the fast channel.
+// Every datagram gets a sequence number and is authenticated, so forged,
+// reflected and replayed datagrams are rejected. Links made with
+// NewTLSLink also encrypt the payload. The traffic is recorded in the
+// Meter of the link.
+type Link struct {
+	connId uint32
+	seq    atomic.Uint64
+	meter  Meter
+
+	// plain links
+	sendKey []byte
+	recvKey []byte
+
+	// encrypted links
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+
+	mu     sync.Mutex
+	replay ReplayWindow
+
+	write          func(packet []byte) error
+	packetSize     atomic.Int64
+	maxMessageSize atomic.Uint32
+	fragId         atomic.Uint32
+
+	// state of the sequenced and reliable channels
+	chanMu      sync.Mutex
+	send        [numChannels]sendState
+	recv        [numChannels]recvState
+	reassembler reassembler
+
+	mtuMu  sync.Mutex
+	prober mtuProber
+}
+
+// Datagram is an authenticated datagram, ready to be passed to Receive.
+type Datagram struct {
+	HandlerId uint32
+	Channel   Channel
+	header    header
+	data      []byte
+	size      int
+}
+
+// NewLink returns a link that authenticates datagrams with keys derived
+// from the session secret. Each direction gets its own key so a datagram
+// can't be reflected back to its sender.
+func NewLink(connId uint32, secret []byte, server bool) *Link {
+	l := newLink(connId)
+	clientKey := deriveKey(secret, "client to server")
+	serverKey := deriveKey(secret, "server to client")
+	if server {
+		l.sendKey, l.recvKey = serverKey, clientKey
+	} else {
+		l.sendKey, l.recvKey = clientKey, serverKey
+	}
+	return l
+}
+
+// NewTLSLink returns a link that encrypts and authenticates datagrams with
+// AES-GCM, keyed from the tls connection the session was set up on.
+func NewTLSLink(connId uint32, state tls.ConnectionState, server bool) (*Link, error) {
+	keys, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAEAD, err := newAEAD(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	serverAEAD, err := newAEAD(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLink(connId)
+	if server {
+		l.sendAEAD, l.recvAEAD = serverAEAD, clientAEAD
+	} else {
+		l.sendAEAD, l.recvAEAD = clientAEAD, serverAEAD
+	}
+	return l, nil
+}
+
+func newLink(connId uint32) *Link {
+	l := &Link{connId: connId}
+	l.packetSize.Store(DefaultPacketSize)
+	l.maxMessageSize.Store(DefaultMaxMessageSize)
+	l.reassembler.partials = make(map[uint32]*partial)
+	for ch := range numChannels {
+		l.send[ch].pending = make(map[uint32]*pending)
+		l.recv[ch].seen = make(map[uint32]struct{})
+		l.recv[ch].held = make(map[uint32]Message)
+	}
+	return l
+}
+
+// SetWriter sets how the link puts datagrams on the wire. It has to be set
+// before anything is sent, as acks and resends go out on their own.
+func (l *Link) SetWriter(write func(packet []byte) error) {
+	l.write = write
+}
+
+// SetPacketSize sets the largest payload put in a single datagram, bigger
+// messages are split into fragments. The peer must be able to receive
+// datagrams of size plus MaxDatagramOverhead bytes.
+func (l *Link) SetPacketSize(size int) {
+	l.packetSize.Store(int64(size))
+}
+
+func (l *Link) PacketSize() int {
+	return int(l.packetSize.Load())
+}
+
+// SetMaxMessageSize caps the size of a message, both the ones sent and the
+// ones put back together from fragments.
+func (l *Link) SetMaxMessageSize(size uint32) {
+	l.maxMessageSize.Store(size)
+}
+
+func (l *Link) ConnId() uint32 {
+	return l.connId
+}
+
+func (l *Link) Meter() *Meter {
+	return &l.meter
+}
+
+// Stats returns the Stats recorded by the meter of the link along with the
+// discovered MTU.
+func (l *Link) Stats() Stats {
+	stats := l.meter.Stats()
+	stats.MTU = l.MTU()
+	return stats
+}
+
+// Send sends data to handlerId of the peer on one of the fast channels.
+// Messages bigger than the packet size are split into fragments. Messages
+// on the reliable channels are kept until the peer acknowledges them, so
+// once accepted they are resent even if the first write fails.
+func (l *Link) Send(ch Channel, handlerId uint32, data []byte) error {
+	if l.write == nil {
+		return ErrNoWriter
+	}
+	if limit := l.maxMessageSize.Load(); uint64(len(data)) > uint64(limit) {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrFrameTooLarge, len(data), limit)
+	}
+
+	h := header{handlerId: handlerId, ch: ch}
+	switch ch {
+	case Fast:
+		return l.transmit(h, data)
+	case Sequenced:
+		l.chanMu.Lock()
+		l.send[ch].next++
+		h.seq = l.send[ch].next
+		l.chanMu.Unlock()
+		return l.transmit(h, data)
+	case Reliable, ReliableOrdered:
+		l.chanMu.Lock()
+		state := &l.send[ch]
+		if len(state.pending) >= reliableWindow {
+			l.chanMu.Unlock()
+			return ErrWindowFull
+		}
+		state.next++
+		h.seq = state.next
+		// resends reuse the fragment id, so fragments from different
+		// attempts can complete each other
+		h.fragId = l.fragId.Add(1)
+		state.pending[h.seq] = &pending{
+			header: h,
+			data:   append([]byte(nil), data...),
+			sentAt: time.Now(),
+			tries:  1,
+		}
+		l.chanMu.Unlock()
+
+		// a failed write is treated like a lost datagram
+		l.transmit(h, data)
+		return nil
+	}
+	return fmt.Errorf("%v is not a fast channel", ch)
+}
+
+// transmit writes data in as many datagrams as the packet size requires.
+func (l *Link) transmit(h header, data []byte) error {
+	size := l.PacketSize()
+	if len(data) <= size {
+		return l.write(l.seal(h, data))
+	}
+
+	count := (len(data) + size - 1) / size
+	if count > maxFragments {
+		return fmt.Errorf("%w: %d bytes need %d fragments", ErrFrameTooLarge, len(data), count)
+	}
+	h.fragmented = true
+	h.count = uint16(count)
+	if h.fragId == 0 {
+		h.fragId = l.fragId.Add(1)
+	}
+
+	var errs []error
+	for i := range count {
+		h.index = uint16(i)
+		chunk := data[i*size : min((i+1)*size, len(data))]
+		if err := l.write(l.seal(h, chunk)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// seal builds the datagram carrying data.
+func (l *Link) seal(h header, data []byte) []byte {
+	seq := l.seq.Add(1)
+
+	packet := make([]byte, DatagramHeaderSize, MaxDatagramOverhead+len(data))
+	binary.BigEndian.PutUint32(packet[:4], l.connId)
+	binary.BigEndian.PutUint64(packet[4:12], seq)
+
+	body := packet[DatagramHeaderSize:]
+	if l.sendAEAD != nil {
+		// encrypt from a copy, the ciphertext goes where body is now
+		body = make([]byte, 0, h.size()+len(data))
+	}
+	body = h.append(body)
+	body = append(body, data...)
+
+	if l.sendAEAD != nil {
+		packet = l.sendAEAD.Seal(packet, nonce(seq), body, packet[:DatagramHeaderSize])
+	} else {
+		packet = packet[:DatagramHeaderSize+len(body)]
+		packet = append(packet, tag(l.sendKey, packet)...)
+	}
+
+	l.meter.sentFast(len(packet))
+	return packet
+}
+
+// Open authenticates a datagram. Each datagram is only accepted once.
+// Encrypted datagrams are decrypted in place, so the payload always
+// aliases packet.
+func (l *Link) Open(packet []byte) (Datagram, error) {
+	if len(packet) < DatagramOverhead {
+		return Datagram{}, ErrShortDatagram
+	}
+	if binary.BigEndian.Uint32(packet[:4]) != l.connId {
+		return Datagram{}, ErrBadTag
+	}
+	seq := binary.BigEndian.Uint64(packet[4:12])
+
+	var body []byte
+	if l.recvAEAD != nil {
+		var err error
+		sealed := packet[DatagramHeaderSize:]
+		body, err = l.recvAEAD.Open(sealed[:0], nonce(seq), sealed, packet[:DatagramHeaderSize])
+		if err != nil {
+			return Datagram{}, ErrBadTag
+		}
+	} else {
+		signed := packet[:len(packet)-TagSize]
+		if !hmac.Equal(tag(l.recvKey, signed), packet[len(signed):]) {
+			return Datagram{}, ErrBadTag
+		}
+		body = signed[DatagramHeaderSize:]
+	}
+
+	l.mu.Lock()
+	fresh := l.replay.Accept(seq)
+	l.mu.Unlock()
+	if !fresh {
+		return Datagram{}, ErrReplay
+	}
+	l.meter.receivedFast(len(packet), seq)
+
+	h, data, err := parseHeader(body)
+	if err != nil {
+		return Datagram{}, err
+	}
+	return Datagram{HandlerId: h.handlerId, Channel: h.ch, header: h, data: data, size: len(packet)}, nil
+}
+
+// Receive returns the messages an opened datagram makes deliverable, in the
+// order they should be handled. Fragments are held until their message is
+// complete, duplicates and stale messages are dropped, and reliable
+// messages are acknowledged.
+func (l *Link) Receive(d Datagram) []Message {
+	h := d.header
+	m := Message{HandlerId: h.handlerId, Data: d.data, Borrowed: true}
+
+	if h.fragmented {
+		l.chanMu.Lock()
+		whole, ok := l.reassembler.add(h, d.data, l.maxMessageSize.Load(), time.Now())
+		l.chanMu.Unlock()
+		if !ok {
+			return nil
+		}
+		m.Data = whole
+		m.Borrowed = false
+	}
+
+	switch h.ch {
+	case Fast:
+		switch h.handlerId {
+		case HandlerAck:
+			l.acked(m.Data)
+			return nil
+		case HandlerMTUProbe:
+			if l.write != nil {
+				l.probed(d.size)
+			}
+			return nil
+		case HandlerMTUAck:
+			l.probeAcked(m.Data)
+			return nil
+		}
+		return []Message{m}
+	case Sequenced:
+		l.chanMu.Lock()
+		defer l.chanMu.Unlock()
+		state := &l.recv[h.ch]
+		if h.seq <= state.last {
+			return nil
+		}
+		state.last = h.seq
+		return []Message{m}
+	}
+
+	l.chanMu.Lock()
+	state := &l.recv[h.ch]
+	state.track(h.seq)
+	out := state.receiveReliable(h.ch, h.seq, m)
+	ack := state.ack(h.ch)
+	l.chanMu.Unlock()
+
+	if l.write != nil {
+		l.write(l.seal(header{handlerId: HandlerAck, ch: Fast}, ack))
+	}
+	return out
+}
+
+// Room returns how many messages a receiver has to be able to take for d,
+// now or once the gap before it is filled. A reliable datagram it has no
+// room for can be dropped before Receive, unacknowledged, the peer resends
+// it later.
+func (l *Link) Room(d Datagram) int {
+	h := d.header
+	if !h.ch.reliable() {
+		return 1
+	}
+
+	l.chanMu.Lock()
+	defer l.chanMu.Unlock()
+	return l.recv[h.ch].room(h.ch, h.seq)
+}
+
+// acked drops the messages an ack from the peer confirms.
+func (l *Link) acked(data []byte) {
+	if len(data) != ackSize {
+		return
+	}
+	ch := Channel(data[0])
+	if !ch.reliable() {
+		return
+	}
+	cumulative := binary.BigEndian.Uint32(data[1:5])
+	highest := binary.BigEndian.Uint32(data[5:9])
+	bits := binary.BigEndian.Uint32(data[9:13])
+
+	l.chanMu.Lock()
+	defer l.chanMu.Unlock()
+	state := &l.send[ch]
+	for seq, p := range state.pending {
+		if seq < cumulative || seq == highest {
+			l.sampleRTT(p)
+			delete(state.pending, seq)
+		} else if seq < highest && highest-seq <= 32 && bits&(1<<(highest-seq-1)) != 0 {
+			l.sampleRTT(p)
+			delete(state.pending, seq)
+		}
+	}
+}
+
+// sampleRTT feeds the time it took to ack p into the meter, resent messages
+// are skipped as it is not known which copy was acked.
+func (l *Link) sampleRTT(p *pending) {
+	if p.tries == 1 {
+		l.meter.AddRTTSample(time.Since(p.sentAt))
+	}
+}
+
+// retransmit sends the reliable messages whose ack is overdue again, waiting
+// twice as long for every resend of the same message. It also drops
+// fragments that waited too long for the rest of their message.
+func (l *Link) retransmit(now time.Time) {
+	stats := l.meter.Stats()
+	rto := defaultRTO
+	if stats.RTT > 0 {
+		rto = min(max(stats.RTT+4*stats.RTTVar, minRTO), maxRTO)
+	}
+
+	type resend struct {
+		header header
+		data   []byte
+	}
+	var due []resend
+
+	l.chanMu.Lock()
+	l.reassembler.expire(now)
+	for _, ch := range []Channel{Reliable, ReliableOrdered} {
+		for _, p := range l.send[ch].pending {
+			wait := min(rto<<min(p.tries-1, 5), maxRTO)
+			if now.Sub(p.sentAt) < wait {
+				continue
+			}
+			p.sentAt = now
+			p.tries++
+			due = append(due, resend{p.header, p.data})
+		}
+	}
+	l.chanMu.Unlock()
+
+	for _, r := range due {
+		l.transmit(r.header, r.data)
+	}
+}
+
+// Run does the housekeeping of the link until done is closed: resending
+// unacknowledged messages, dropping stale fragments and probing the MTU.
+func (l *Link) Run(done <-chan struct{}) {
+	if l.write == nil {
+		return
+	}
+
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.retransmit(now)
+			l.probe(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// DatagramConnId returns the connection id a datagram claims to come from,
+// it can't be trusted until the datagram has been opened.
+func DatagramConnId(packet []byte) (uint32, error) {
+	if len(packet) < DatagramOverhead {
+		return 0, ErrShortDatagram
+	}
+	return binary.BigEndian.Uint32(packet[:4]), nil
+}
+
+// replayWindowSize is how many sequence numbers behind the newest one a
+// datagram can be and still be accepted, which bounds how much reordering
+// the fast channel survives.
+const replayWindowSize = 1024
+
+// ReplayWindow remembers which of the last replayWindowSize sequence
+// numbers were seen.
+type ReplayWindow struct {
+	highest uint64
+	seen    [replayWindowSize / 64]uint64
+}
+
+// Accept reports whether seq is new and marks it as seen.
+func (w *ReplayWindow) Accept(seq uint64) bool {
+	if seq == 0 || seq+replayWindowSize <= w.highest {
+		return false
+	}
+
+	if seq > w.highest {
+		// forget the slots the window slides over
+		for s := w.highest + 1; s <= seq && s-w.highest <= replayWindowSize; s++ {
+			w.seen[(s/64)%uint64(len(w.seen))] &^= 1 << (s % 64)
+		}
+		w.highest = seq
+	}
+
+	word, bit := (seq/64)%uint64(len(w.seen)), uint64(1)<<(seq%64)
+	if w.seen[word]&bit != 0 {
+		return false
+	}
+	w.seen[word] |= bit
+	return true
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func tag(key []byte, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return mac.Sum(nil)[:TagSize]
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		seqs []uint64
+		want []bool
+	}{
+		{"in order", []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"zero", []uint64{0}, []bool{false}},
+		{"duplicate", []uint64{1, 1}, []bool{true, false}},
+		{"reordered", []uint64{5, 3, 4, 3}, []bool{true, true, true, false}},
+		{"oldest kept", []uint64{1, replayWindowSize}, []bool{true, true}},
+		{"duplicate of the oldest kept", []uint64{1, replayWindowSize, 1}, []bool{true, true, false}},
+		{"too old", []uint64{replayWindowSize + 1, 1}, []bool{true, false}},
+		{"slot reused", []uint64{1, replayWindowSize + 1, replayWindowSize + 1}, []bool{true, true, false}},
+		{"big jump", []uint64{1, 10 * replayWindowSize, 10*replayWindowSize - 1}, []bool{true, true, true}},
+		{"big jump forgets", []uint64{5, 5 + 10*replayWindowSize, 5 + 9*replayWindowSize + 1}, []bool{true, true, true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var w ReplayWindow
+			for i, seq := range tt.seqs {
+				if got := w.Accept(seq); got != tt.want[i] {
+					t.Errorf("Accept(%d) = %v, want %v", seq, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
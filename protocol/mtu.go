@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// MaxProbeSize is the biggest datagram sent while probing the path MTU, the
+// udp payload of a full 1500 byte ethernet frame over IPv4. Receive buffers
+// must hold at least this much.
+const MaxProbeSize = 1500 - ipv4Overhead
+
+const (
+	probeRounds  = 3
+	probeSpacing = 200 * time.Millisecond
+
+	// ipv4Overhead and ipv6Overhead are the ip and udp headers in front
+	// of a datagram.
+	ipv4Overhead = 20 + 8
+	ipv6Overhead = 40 + 8
+	// minIPv6MTU is the smallest MTU an IPv6 path may have.
+	minIPv6MTU = 1280
+)
+
+// probeMTUs are the path MTUs tried, from ethernet down through PPPoE and
+// common VPNs to the IPv6 and IPv4 minimums.
+var probeMTUs = []int{1500, 1492, 1420, minIPv6MTU, 576}
+
+// probeSizes returns the datagram sizes that fill the probeMTUs on a path
+// to addr.
+func probeSizes(addr netip.Addr) []int {
+	overhead := ipv4Overhead
+	if !addr.Unmap().Is4() {
+		overhead = ipv6Overhead
+	}
+
+	var sizes []int
+	for _, mtu := range probeMTUs {
+		if overhead == ipv6Overhead && mtu < minIPv6MTU {
+			continue
+		}
+		sizes = append(sizes, mtu-overhead)
+	}
+	return sizes
+}
+
+// ReceiveBufferSize returns how big a buffer has to be to receive any
+// datagram from a peer using packetSize, probes included.
+func ReceiveBufferSize(packetSize uint32) int {
+	return max(int(packetSize)+MaxDatagramOverhead, MaxProbeSize)
+}
+
+// mtuProber finds the biggest datagram that makes it to the peer by sending
+// padded probes of every size a few times and keeping the biggest one the
+// peer acknowledged.
+type mtuProber struct {
+	sizes   []int
+	running bool
+	round   int
+	next    time.Time
+	best    int
+	mtu     int
+}
+
+// DiscoverMTU starts probing the path to the peer at addr, the packet size
+// is set from the result once it is done. Nothing happens if a probe is
+// running. The socket should not fragment datagrams, see SetDontFragment.
+func (l *Link) DiscoverMTU(addr netip.Addr) {
+	l.mtuMu.Lock()
+	defer l.mtuMu.Unlock()
+	if l.prober.running {
+		return
+	}
+	l.prober = mtuProber{sizes: probeSizes(addr), running: true, next: time.Now(), mtu: l.prober.mtu}
+}
+
+// MTU returns the biggest datagram known to reach the peer, 0 until the
+// first discovery finished.
+func (l *Link) MTU() int {
+	l.mtuMu.Lock()
+	defer l.mtuMu.Unlock()
+	return l.prober.mtu
+}
+
+// probe sends the next round of probes when it is due, or settles on the
+// result after the last one.
+func (l *Link) probe(now time.Time) {
+	l.mtuMu.Lock()
+	p := &l.prober
+	if !p.running || now.Before(p.next) {
+		l.mtuMu.Unlock()
+		return
+	}
+
+	if p.round == probeRounds {
+		p.running = false
+		if p.best > 0 {
+			p.mtu = p.best
+			l.SetPacketSize(p.best - MaxDatagramOverhead)
+		}
+		l.mtuMu.Unlock()
+		return
+	}
+	p.round++
+	p.next = now.Add(probeSpacing)
+	sizes := p.sizes
+	l.mtuMu.Unlock()
+
+	for _, size := range sizes {
+		// padded so the whole datagram is size bytes
+		data := make([]byte, size-DatagramOverhead)
+		binary.BigEndian.PutUint16(data, uint16(size))
+		l.write(l.seal(header{handlerId: HandlerMTUProbe, ch: Fast}, data))
+	}
+}
+
+// probed answers a probe from the peer with the size that arrived.
+func (l *Link) probed(size int) {
+	data := binary.BigEndian.AppendUint16(nil, uint16(size))
+	l.write(l.seal(header{handlerId: HandlerMTUAck, ch: Fast}, data))
+}
+
+// probeAcked records a probe size the peer received.
+func (l *Link) probeAcked(data []byte) {
+	if len(data) != 2 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(data))
+
+	l.mtuMu.Lock()
+	defer l.mtuMu.Unlock()
+	if l.prober.running && size > l.prober.best && size <= MaxProbeSize {
+		l.prober.best = size
+	}
+}
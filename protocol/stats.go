@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lossInterval is how many datagrams the peer has to send before a new
+// loss sample is taken.
+const lossInterval = 64
+
+type ChannelStats struct {
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+}
+
+// Stats describes the quality of the link to one peer.
+type Stats struct {
+	// RTT is the smoothed round trip time and RTTVar its variance, both
+	// computed from the heartbeat like tcp does (RFC 6298).
+	RTT    time.Duration
+	RTTVar time.Duration
+	// Loss is the smoothed fraction of the datagrams sent by the peer that
+	// never arrived.
+	Loss float64
+	// MTU is the biggest datagram known to reach the peer, 0 until path
+	// MTU discovery finished.
+	MTU  int
+	Safe ChannelStats
+	Fast ChannelStats
+}
+
+// Meter collects the Stats of one link, it is safe for concurrent use.
+type Meter struct {
+	safe channelCounters
+	fast channelCounters
+
+	mu       sync.Mutex
+	srtt     time.Duration
+	rttvar   time.Duration
+	loss     float64
+	sampled  bool
+	started  bool
+	base     uint64
+	highest  uint64
+	received uint64
+}
+
+type channelCounters struct {
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+}
+
+func (c *channelCounters) sent(n int) {
+	c.bytesSent.Add(uint64(n))
+	c.packetsSent.Add(1)
+}
+
+func (c *channelCounters) received(n int) {
+	c.bytesReceived.Add(uint64(n))
+	c.packetsReceived.Add(1)
+}
+
+func (c *channelCounters) stats() ChannelStats {
+	return ChannelStats{
+		BytesSent:       c.bytesSent.Load(),
+		BytesReceived:   c.bytesReceived.Load(),
+		PacketsSent:     c.packetsSent.Load(),
+		PacketsReceived: c.packetsReceived.Load(),
+	}
+}
+
+// SentSafe records a frame of n bytes, header included, sent over tcp.
+func (m *Meter) SentSafe(n int) {
+	m.safe.sent(n)
+}
+
+// ReceivedSafe records a frame with a payload of n bytes read from tcp.
+func (m *Meter) ReceivedSafe(n int) {
+	m.safe.received(FrameHeaderSize + n)
+}
+
+func (m *Meter) sentFast(n int) {
+	m.fast.sent(n)
+}
+
+// receivedFast records an authenticated datagram of n bytes with sequence
+// number seq, gaps in the sequence numbers count as loss.
+func (m *Meter) receivedFast(n int, seq uint64) {
+	m.fast.received(n)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.started {
+		m.base = seq - 1
+		m.started = true
+	}
+	if seq > m.highest {
+		m.highest = seq
+	}
+	m.received++
+
+	expected := m.highest - m.base
+	if expected < lossInterval {
+		return
+	}
+	sample := 1 - float64(m.received)/float64(expected)
+	sample = max(0, min(1, sample))
+	if m.sampled {
+		m.loss += (sample - m.loss) / 8
+	} else {
+		m.loss = sample
+		m.sampled = true
+	}
+	m.base = m.highest
+	m.received = 0
+}
+
+// AddRTTSample feeds a measured round trip time into the estimate.
+func (m *Meter) AddRTTSample(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.srtt == 0 {
+		m.srtt = rtt
+		m.rttvar = rtt / 2
+		return
+	}
+	m.rttvar += (max(m.srtt-rtt, rtt-m.srtt) - m.rttvar) / 4
+	m.srtt += (rtt - m.srtt) / 8
+}
+
+func (m *Meter) Stats() Stats {
+	m.mu.Lock()
+	stats := Stats{RTT: m.srtt, RTTVar: m.rttvar, Loss: m.loss}
+	m.mu.Unlock()
+
+	stats.Safe = m.safe.stats()
+	stats.Fast = m.fast.stats()
+	return stats
+}
+
+// epoch makes ping timestamps monotonic, they are only ever compared with
+// the clock of the process that made them.
+var epoch = time.Now()
+
+// PingPayload returns the payload of a ping sent now.
+func PingPayload() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Since(epoch)))
+}
+
+// PongRTT returns the round trip time of the ping echoed back in a pong.
+func PongRTT(data []byte) (time.Duration, bool) {
+	if len(data) != 8 {
+		return 0, false
+	}
+	rtt := time.Since(epoch) - time.Duration(binary.BigEndian.Uint64(data))
+	return rtt, rtt > 0
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"flera/protocol"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errRejected is returned by newConn for a client that was turned away and
+// told why.
+var errRejected = errors.New("client rejected")
+
+// AcceptHook decides whether a client connecting from remoteAddr is let in,
+// reason is told to the clients it turns away.
+type AcceptHook func(s *Server, remoteAddr net.Addr) (ok bool, reason string)
+
+// admit checks a connecting client against OnAccept, its address was
+// checked against the bans when it was accepted.
+func (s *Server) admit(tcpConn net.Conn) error {
+	if s.OnAccept != nil {
+		if ok, reason := s.OnAccept(s, tcpConn.RemoteAddr()); !ok {
+			return s.reject(tcpConn, protocol.DisconnectReason{Code: protocol.Rejected, Message: reason})
+		}
+	}
+
+	return nil
+}
+
+// seat takes one of the MaxConnections for a new connection, it is given
+// back by end.
+func (s *Server) seat(tcpConn net.Conn) error {
+	for {
+		seats := s.seats.Load()
+		if s.MaxConnections > 0 && seats >= int64(s.MaxConnections) {
+			return s.reject(tcpConn, protocol.DisconnectReason{Code: protocol.ServerFull})
+		}
+		if s.seats.CompareAndSwap(seats, seats+1) {
+			return nil
+		}
+	}
+}
+
+// reject turns a client away before it got a connection, telling it why.
+func (s *Server) reject(tcpConn net.Conn, reason protocol.DisconnectReason) error {
+	s.logger().Info("rejected", "addr", tcpConn.RemoteAddr(), "reason", reason)
+	tcpConn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	protocol.WriteFrame(tcpConn, protocol.HandlerClose, reason.Marshal(), s.MaxMessageSize)
+	return fmt.Errorf("%w: %s", errRejected, reason)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flera/protocol"
+	"net"
+	"net/netip"
+)
+
+// Authenticator checks the credentials a client connected with and returns
+// the identity it authenticated as. An error turns the client away, only the
+// message of an *AuthError is told to the client. ctx is done once the
+// handshake takes too long or the server shuts down.
+type Authenticator func(ctx context.Context, credentials []byte) (identity string, err error)
+
+// AuthError is an error of an Authenticator meant for the client, like
+// "wrong password". Other errors may tell too much, so the client only
+// learns it is unauthorized.
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// authenticate runs Authenticate on the credentials of a connecting client
+// and checks its identity against the bans.
+func (s *Server) authenticate(tcpConn net.Conn, credentials []byte) (string, error) {
+	if s.Authenticate == nil {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.closeCtx, handshakeTimeout)
+	defer cancel()
+	identity, err := s.Authenticate(ctx, credentials)
+	if err != nil {
+		reason := protocol.DisconnectReason{Code: protocol.Unauthorized}
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			reason.Message = authErr.Message
+		} else {
+			s.logger().Warn("authenticate failed", "addr", tcpConn.RemoteAddr(), "err", err)
+		}
+		return "", s.reject(tcpConn, reason)
+	}
+
+	ban, err := s.banned(netip.Addr{}, identity)
+	if err != nil {
+		return "", err
+	}
+	if ban != nil {
+		return "", s.reject(tcpConn, protocol.DisconnectReason{Code: protocol.Banned, Message: ban.Reason})
+	}
+	return identity, nil
+}
+
+// IdentityHandler handles one message like a Handler, along with the
+// identity its client authenticated as.
+type IdentityHandler func(s *Server, connId uint32, identity string, data []byte) error
+
+// RegisterIdentity registers a handler that is given the identity of the
+// client that sent the message.
+func (s *Server) RegisterIdentity(handlerId uint32, h IdentityHandler) {
+	s.register(handlerId, handler{identityFn: h})
+}
+
+// Identity returns the identity a client authenticated as, empty without
+// an Authenticate callback.
+func (s *Server) Identity(connId uint32) (string, error) {
+	c, err := s.getConn(connId)
+	if err != nil {
+		return "", err
+	}
+	return c.identity, nil
+}
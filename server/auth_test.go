@@ -0,0 +1,90 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"flera/client"
+	"flera/protocol"
+	"flera/server"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdentityReachesHandler(t *testing.T) {
+	identities := make(chan string, 1)
+	_, addr := startServer(t, func(s *server.Server) {
+		s.Authenticate = func(ctx context.Context, credentials []byte) (string, error) {
+			return string(credentials), nil
+		}
+		s.RegisterIdentity(1, func(s *server.Server, connId uint32, identity string, data []byte) error {
+			identities <- identity
+			return nil
+		})
+	})
+	c := connect(t, addr, func(c *client.Client) {
+		c.Credentials = []byte("alice")
+	})
+
+	if err := c.Send(protocol.Safe, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case identity := <-identities:
+		if identity != "alice" {
+			t.Errorf("handler got identity %q, want %q", identity, "alice")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler never ran")
+	}
+}
+
+// A slow Authenticate must not hold up a shutdown.
+func TestShutdownCancelsAuthentication(t *testing.T) {
+	authenticating := make(chan struct{})
+	s, addr := startServer(t, func(s *server.Server) {
+		s.Authenticate = func(ctx context.Context, credentials []byte) (string, error) {
+			close(authenticating)
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+	})
+	go client.New().Connect(addr)
+	<-authenticating
+
+	start := time.Now()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+}
+
+// Only an *AuthError tells the client why it was refused.
+func TestAuthenticateErrorMessages(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{&server.AuthError{Message: "wrong password"}, "wrong password"},
+		{fmt.Errorf("login: %w", &server.AuthError{Message: "wrong password"}), "wrong password"},
+		{errors.New("dial tcp 10.0.0.5:5432: connection refused"), ""},
+	} {
+		_, addr := startServer(t, func(s *server.Server) {
+			s.Authenticate = func(ctx context.Context, credentials []byte) (string, error) {
+				return "", tt.err
+			}
+		})
+
+		err := client.New().Connect(addr)
+		var rejected *client.RejectedError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("connect returned %v, want a *client.RejectedError", err)
+		}
+		want := protocol.DisconnectReason{Code: protocol.Unauthorized, Message: tt.want}
+		if rejected.Reason != want {
+			t.Errorf("%v: rejected with %v, want %v", tt.err, rejected.Reason, want)
+		}
+	}
+}
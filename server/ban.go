@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"flera/protocol"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Ban keeps clients out of the server. It matches a client by its address
+// when Prefix is valid, or by the identity it authenticated as when
+// Identity is set.
+type Ban struct {
+	// Prefix is the address range banned, a single address is a /32 or
+	// /128 prefix.
+	Prefix   netip.Prefix
+	Identity string
+	// Reason is told to the banned clients.
+	Reason string
+	// Expires is when the ban is lifted, the zero time never lifts it.
+	Expires time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+func (b Ban) matches(addr netip.Addr, identity string) bool {
+	if b.Prefix.IsValid() && addr.IsValid() && b.Prefix.Contains(addr.Unmap()) {
+		return true
+	}
+	return b.Identity != "" && b.Identity == identity
+}
+
+// BanStore keeps the bans of a server, implement it to persist them.
+type BanStore interface {
+	// Add stores a ban, replacing the one on the same Prefix and Identity.
+	Add(ban Ban) error
+	// Remove lifts the ban on the Prefix and Identity of ban.
+	Remove(ban Ban) error
+	// List returns every ban, expired ones included.
+	List() ([]Ban, error)
+}
+
+type banKey struct {
+	prefix   netip.Prefix
+	identity string
+}
+
+// MemoryBanStore keeps bans in memory, they are gone once the server
+// stops. It is the BanStore of a new server.
+type MemoryBanStore struct {
+	mu   sync.Mutex
+	bans map[banKey]Ban
+}
+
+func NewMemoryBanStore() *MemoryBanStore {
+	return &MemoryBanStore{bans: make(map[banKey]Ban)}
+}
+
+func (m *MemoryBanStore) Add(ban Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans[banKey{ban.Prefix, ban.Identity}] = ban
+	return nil
+}
+
+func (m *MemoryBanStore) Remove(ban Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bans, banKey{ban.Prefix, ban.Identity})
+	return nil
+}
+
+func (m *MemoryBanStore) List() ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// Kick disconnects a client, telling it message. A kicked client can't
+// resume its session, kicking a suspended session ends it.
+func (s *Server) Kick(connId uint32, message string) error {
+	reason := protocol.DisconnectReason{Code: protocol.Kicked, Message: message}
+	c, err := s.getConn(connId)
+	if err == nil {
+		c.log.Info("kicking", "reason", reason)
+		s.disconnect(c, reason)
+	}
+	// the connection may have just been lost and its session suspended
+	if s.endSession(connId, reason) {
+		return nil
+	}
+	return err
+}
+
+// Ban stores ban in Bans and disconnects the clients it matches. A banned
+// client is turned away when it connects until the ban expires.
+func (s *Server) Ban(ban Ban) error {
+	if !ban.Prefix.IsValid() && ban.Identity == "" {
+		return errors.New("ban needs a prefix or an identity")
+	}
+	ban.Prefix = ban.Prefix.Masked()
+	if err := s.Bans.Add(ban); err != nil {
+		return err
+	}
+
+	reason := protocol.DisconnectReason{Code: protocol.Banned, Message: ban.Reason}
+	s.rangeConns(func(c *conn) bool {
+		if ban.matches(c.addr, c.identity) {
+			c.log.Info("banning", "reason", reason)
+			s.disconnect(c, reason)
+		}
+		return true
+	})
+	return nil
+}
+
+// BanAddr bans an ip address, or a range of them in CIDR notation like
+// "10.0.0.0/8", for d. 0 bans it for good.
+func (s *Server) BanAddr(addr string, d time.Duration, reason string) error {
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		ip, ipErr := netip.ParseAddr(addr)
+		if ipErr != nil {
+			return fmt.Errorf("%q is neither an ip address nor a CIDR prefix", addr)
+		}
+		ip = ip.Unmap()
+		prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+	return s.Ban(Ban{Prefix: prefix, Reason: reason, Expires: expiry(d)})
+}
+
+// BanIdentity bans an application identity for d. 0 bans it for good.
+func (s *Server) BanIdentity(identity string, d time.Duration, reason string) error {
+	return s.Ban(Ban{Identity: identity, Reason: reason, Expires: expiry(d)})
+}
+
+// Unban lifts the ban on the Prefix and Identity of ban.
+func (s *Server) Unban(ban Ban) error {
+	ban.Prefix = ban.Prefix.Masked()
+	return s.Bans.Remove(ban)
+}
+
+// refuseBanned closes tcpConn right after it was accepted if its address
+// is banned, before any handshake. Over tls the client can't read a close
+// frame yet, so it only sees the connection close.
+func (s *Server) refuseBanned(tcpConn net.Conn) bool {
+	ban, err := s.banned(remoteAddr(tcpConn), "")
+	if err != nil {
+		s.logger().Warn("checking bans failed", "addr", tcpConn.RemoteAddr(), "err", err)
+		tcpConn.Close()
+		return true
+	}
+	if ban == nil {
+		return false
+	}
+
+	reason := protocol.DisconnectReason{Code: protocol.Banned, Message: ban.Reason}
+	if s.TLSConfig != nil {
+		s.logger().Info("rejected", "addr", tcpConn.RemoteAddr(), "reason", reason)
+	} else {
+		s.reject(tcpConn, reason)
+	}
+	tcpConn.Close()
+	return true
+}
+
+// banned returns the ban matching a client, or nil. Expired bans are
+// removed on the way.
+func (s *Server) banned(addr netip.Addr, identity string) (*Ban, error) {
+	bans, err := s.Bans.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.expired(now) {
+			if err := s.Bans.Remove(ban); err != nil {
+				s.logger().Warn("removing expired ban failed", "err", err)
+			}
+			continue
+		}
+		if ban.matches(addr, identity) {
+			return &ban, nil
+		}
+	}
+	return nil, nil
+}
+
+func expiry(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func remoteAddr(tcpConn net.Conn) netip.Addr {
+	if addr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,48 @@
+package server_test
+
+import (
+	"errors"
+	"flera/client"
+	"flera/protocol"
+	"flera/server"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// A banned address is turned away as soon as it is accepted, without
+// waiting for its handshake.
+func TestBannedAddrRefusedOnAccept(t *testing.T) {
+	s, addr := startServer(t, nil)
+	if err := s.BanAddr("127.0.0.1", 0, "cheating"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.New().Connect(addr)
+	var rejected *client.RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("connect returned %v, want a *client.RejectedError", err)
+	}
+	want := protocol.DisconnectReason{Code: protocol.Banned, Message: "cheating"}
+	if rejected.Reason != want {
+		t.Errorf("rejected with %v, want %v", rejected.Reason, want)
+	}
+
+	// a client that says nothing is closed all the same
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	handlerId, _, err := protocol.ReadFrame(tcpConn, protocol.DefaultMaxMessageSize)
+	if err != nil || handlerId != protocol.HandlerClose {
+		t.Fatalf("expected close, got handler %d: %v", handlerId, err)
+	}
+
+	if err := s.Unban(server.Ban{Prefix: netip.MustParsePrefix("127.0.0.1/32")}); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, addr, nil)
+}
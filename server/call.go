@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"flera/protocol"
+)
+
+// CallHandler handles a call from a client, what it returns is sent back
+// as the reply. An error reaches the caller as a *protocol.RemoteError.
+type CallHandler func(s *Server, connId uint32, data []byte) ([]byte, error)
+
+// RegisterCall registers a handler that answers calls. Plain messages sent
+// to it run it too, the reply is then dropped. Handlers registered with
+// Register can also be called, they reply with no data or their error.
+func (s *Server) RegisterCall(handlerId uint32, h CallHandler) {
+	s.register(handlerId, handler{callFn: h})
+}
+
+// Call runs handlerId on a client over the safe channel and waits for its
+// reply, until ctx is done. An error returned by the handler comes back as
+// a *protocol.RemoteError.
+func (s *Server) Call(ctx context.Context, connId uint32, handlerId uint32, data []byte) ([]byte, error) {
+	c, err := s.getConn(connId)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.calls.Do(ctx, handlerId, data, func(call []byte) error {
+		return s.writeTcp(c, protocol.HandlerCall, call)
+	})
+}
+
+// readCall turns a frame from c into the message for its handler. Replies
+// to calls made by the server are handed to the caller, for them no message
+// is returned.
+func (s *Server) readCall(c *conn, handlerId uint32, data []byte) (*message, error) {
+	switch handlerId {
+	case protocol.HandlerCall:
+		var call protocol.Call
+		if err := call.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		return &message{handlerId: call.HandlerId, data: call.Data, call: true, callId: call.Id}, nil
+	case protocol.HandlerReply:
+		var reply protocol.Reply
+		if err := reply.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		c.calls.Finish(reply)
+		return nil, nil
+	}
+	return &message{handlerId: handlerId, data: data}, nil
+}
+
+// reply answers the call m with what its handler returned.
+func (s *Server) reply(c *conn, m message, data []byte, err error) {
+	call := protocol.Call{Id: m.callId, HandlerId: m.handlerId}
+	reply := protocol.NewReply(call, data, err).Fit(s.MaxMessageSize)
+	if err := s.writeTcp(c, protocol.HandlerReply, reply.Marshal()); err != nil {
+		c.log.Warn("sending reply failed", "handlerId", m.handlerId, "err", err)
+	}
+}
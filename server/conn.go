@@ -0,0 +1,87 @@
+package server
+
+import (
+	"flera/protocol"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+type conn struct {
+	id   uint32
+	tcp  net.Conn
+	link *protocol.Link
+	// addr is the ip address of the client
+	addr netip.Addr
+	// identity is what the client authenticated as
+	identity string
+	// log is the Logger of the server with the connId and addr attributes
+	log *slog.Logger
+	// token resumes the session of the connection once it is lost
+	token []byte
+	// udpAddr is nil until the client said hello over udp
+	udpAddr atomic.Pointer[netip.AddrPort]
+	// udpSeen is when the last datagram came in, as unix nanoseconds
+	udpSeen atomic.Int64
+
+	// messages waiting for their handlers, see work. datagrams only takes
+	// what came over udp, so the udp reader knows what fits in it
+	queue     chan message
+	datagrams chan message
+	closed    chan struct{}
+	// the worker, the heartbeat and the concurrent handlers still running
+	inflight sync.WaitGroup
+	// calls made to the client that wait for their reply
+	calls protocol.Calls
+	// reason is why the connection ends, nil while it is up
+	reason   *protocol.DisconnectReason
+	reasonMu sync.Mutex
+}
+
+// stop records why the connection ends, only the first reason sticks. It
+// returns the reason that stuck and whether it was this one.
+func (c *conn) stop(reason protocol.DisconnectReason) (protocol.DisconnectReason, bool) {
+	c.reasonMu.Lock()
+	defer c.reasonMu.Unlock()
+	if c.reason != nil {
+		return *c.reason, false
+	}
+	c.reason = &reason
+	return reason, true
+}
+
+func (s *Server) getConn(connId uint32) (*conn, error) {
+	val, ok := s.conns.Load(connId)
+	if !ok {
+		return nil, fmt.Errorf("Could not find %d in the connMap", connId)
+	}
+
+	c, ok := val.(*conn)
+	if !ok {
+		return nil, fmt.Errorf("Could not convert conn map output to conn")
+	}
+
+	return c, nil
+}
+
+func (s *Server) rangeConns(f func(c *conn) bool) {
+	s.conns.Range(func(_, value any) bool {
+		c, ok := value.(*conn)
+		if !ok {
+			return true
+		}
+		return f(c)
+	})
+}
+
+// Stats returns the link quality and traffic of a connection.
+func (s *Server) Stats(connId uint32) (protocol.Stats, error) {
+	c, err := s.getConn(connId)
+	if err != nil {
+		return protocol.Stats{}, err
+	}
+	return c.link.Stats(), nil
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"flera/protocol"
+	"fmt"
+)
+
+// queueSize is how many messages from one client can wait for their
+// handlers on each transport before the client is slowed down (tcp and
+// reliable udp) or dropped from (udp).
+const queueSize = 256
+
+type handler struct {
+	fn         Handler
+	callFn     CallHandler
+	identityFn IdentityHandler
+	concurrent bool
+}
+
+type message struct {
+	handlerId uint32
+	data      []byte
+	// call is set when the client waits for a reply to callId
+	call   bool
+	callId uint32
+	// buf backs data when it came from the udp buffer pool, it is handed
+	// back once the handler returned
+	buf *[]byte
+}
+
+func (s *Server) Register(handlerId uint32, h Handler) {
+	s.register(handlerId, handler{fn: h})
+}
+
+// RegisterConcurrent registers a handler that does not care about order.
+// Messages for it are started in their own goroutine instead of waiting for
+// the previous messages from the same client to be handled.
+func (s *Server) RegisterConcurrent(handlerId uint32, h Handler) {
+	s.register(handlerId, handler{fn: h, concurrent: true})
+}
+
+func (s *Server) register(handlerId uint32, h handler) {
+	if protocol.IsReserved(handlerId) {
+		panic(fmt.Sprintf("flera: handler id %d is reserved", handlerId))
+	}
+	s.handlers[handlerId] = h
+}
+
+// enqueue hands a message over to the worker of c, waiting for room in the
+// queue.
+func (c *conn) enqueue(m message) {
+	select {
+	case c.queue <- m:
+	case <-c.closed:
+	}
+}
+
+// tryEnqueue hands a message that came over udp to the worker of c. It
+// drops m instead of waiting when the queue is full, which can't happen to
+// messages there was room for.
+func (c *conn) tryEnqueue(m message) bool {
+	select {
+	case c.datagrams <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// room reports whether n more messages fit in the udp queue of c. Only the
+// udp reader adds to it, so they still fit when it gets to them.
+func (c *conn) room(n int) bool {
+	return cap(c.datagrams)-len(c.datagrams) >= n
+}
+
+// work runs the handlers for the messages of c in the order they arrived
+// on each transport, until c is closed and its queues are drained.
+func (s *Server) work(c *conn) {
+	defer c.inflight.Done()
+
+	for {
+		select {
+		case m := <-c.queue:
+			s.dispatch(c, m)
+		case m := <-c.datagrams:
+			s.dispatch(c, m)
+		case <-c.closed:
+			for {
+				select {
+				case m := <-c.queue:
+					s.dispatch(c, m)
+				case m := <-c.datagrams:
+					s.dispatch(c, m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) dispatch(c *conn, m message) {
+	h, ok := s.handlers[m.handlerId]
+	if !ok {
+		c.log.Debug("no handler", "handlerId", m.handlerId)
+		if m.call {
+			s.reply(c, m, nil, fmt.Errorf("no handler with id %d", m.handlerId))
+		}
+		s.release(m)
+		return
+	}
+
+	if h.concurrent {
+		c.inflight.Add(1)
+		go func() {
+			defer c.inflight.Done()
+			s.run(c, h, m)
+		}()
+		return
+	}
+
+	s.run(c, h, m)
+}
+
+func (s *Server) run(c *conn, h handler, m message) {
+	defer s.release(m)
+
+	var data []byte
+	fn := h.fn
+	if h.callFn != nil {
+		// middleware only sees the error, the reply is kept here
+		fn = func(s *Server, connId uint32, msg []byte) error {
+			var err error
+			data, err = h.callFn(s, connId, msg)
+			return err
+		}
+	}
+	if h.identityFn != nil {
+		fn = func(s *Server, connId uint32, msg []byte) error {
+			return h.identityFn(s, connId, c.identity, msg)
+		}
+	}
+	err := s.invoke(c, m.handlerId, fn, m.data)
+
+	if m.call {
+		// the caller gets the error, only panics are reported here
+		s.reply(c, m, data, err)
+		var panicErr *protocol.PanicError
+		if !errors.As(err, &panicErr) {
+			return
+		}
+	}
+	if err != nil {
+		s.fail(c, m.handlerId, err)
+	}
+}
+
+// release hands the buffer behind m back to the pool, m.data must not be
+// used after it.
+func (s *Server) release(m message) {
+	if m.buf != nil {
+		s.udpBufs.Put(m.buf)
+	}
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flera/protocol"
+	"flera/server"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent handlers outlive the read of the next datagram, the buffer
+// their message points into must not be reused under them.
+func TestConcurrentHandlersKeepTheirData(t *testing.T) {
+	const count = 1000
+
+	var mu sync.Mutex
+	seen := make(map[uint32]bool)
+	var corrupt []uint32
+	ready := make(chan struct{})
+	_, addr := startServer(t, func(s *server.Server) {
+		s.Register(1, func(s *server.Server, connId uint32, data []byte) error {
+			close(ready)
+			return nil
+		})
+		s.RegisterConcurrent(2, func(s *server.Server, connId uint32, data []byte) error {
+			if len(data) != payloadSize {
+				mu.Lock()
+				defer mu.Unlock()
+				corrupt = append(corrupt, 0)
+				return nil
+			}
+			// give the reader time to reuse the buffer if it were to
+			time.Sleep(time.Millisecond)
+			i := binary.BigEndian.Uint32(data)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !bytes.Equal(data[4:], payload(i)[4:]) {
+				corrupt = append(corrupt, i)
+			}
+			seen[i] = true
+			return nil
+		})
+	})
+	c := connect(t, addr, nil)
+
+	// a reliable message only arrives once the udp address is bound
+	if err := c.Send(protocol.Reliable, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp never got bound")
+	}
+
+	for i := range uint32(count) {
+		if err := c.Send(protocol.Fast, 2, payload(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			// fast messages are dropped when they come in faster than
+			// they are read
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(seen)
+		mu.Unlock()
+		if n == count || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(corrupt) > 0 {
+		t.Fatalf("%d payloads were corrupted, the first is %d", len(corrupt), corrupt[0])
+	}
+	if len(seen) < count/2 {
+		t.Fatalf("handler got %d of %d payloads", len(seen), count)
+	}
+}
+
+const payloadSize = 256
+
+// payload is the message i, every byte after the index is byte(i).
+func payload(i uint32) []byte {
+	data := binary.BigEndian.AppendUint32(nil, i)
+	return append(data, bytes.Repeat([]byte{byte(i)}, payloadSize-4)...)
+}
@@ -0,0 +1,33 @@
+package server
+
+import "flera/protocol"
+
+// ErrorHandler is called when a handler returned an error or panicked.
+type ErrorHandler func(s *Server, connId uint32, handlerId uint32, err error)
+
+// invoke runs h in its middleware, a panic is returned as a
+// *protocol.PanicError.
+func (s *Server) invoke(c *conn, handlerId uint32, h Handler, data []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = protocol.NewPanicError(v)
+		}
+	}()
+	return s.wrap(handlerId, h)(s, c.id, data)
+}
+
+// fail reports the error of a handler to OnError and applies the
+// ErrorPolicy.
+func (s *Server) fail(c *conn, handlerId uint32, err error) {
+	if s.OnError != nil {
+		s.OnError(s, c.id, handlerId, err)
+	}
+
+	switch s.ErrorPolicy {
+	case protocol.LogErrors:
+		c.log.Error("handler failed", "handlerId", handlerId, "err", err)
+	case protocol.DisconnectOnError:
+		c.log.Error("handler failed, disconnecting", "handlerId", handlerId, "err", err)
+		s.disconnect(c, protocol.DisconnectReason{Code: protocol.Kicked, Message: "handler failed"})
+	}
+}
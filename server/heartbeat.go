@@ -0,0 +1,66 @@
+package server
+
+import (
+	"flera/protocol"
+	"time"
+)
+
+// heartbeat pings c on both channels every HeartbeatInterval, which keeps
+// the idle timeout of the client from firing, and forgets the udp address
+// of c when nothing came from it for IdleTimeout.
+func (s *Server) heartbeat(c *conn) {
+	defer c.inflight.Done()
+	if s.HeartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		if err := s.writeTcp(c, protocol.HandlerPing, protocol.PingPayload()); err != nil {
+			c.log.Debug("ping failed", "channel", protocol.Safe, "err", err)
+		}
+
+		if c.udpAddr.Load() == nil {
+			continue
+		}
+		seen := time.Unix(0, c.udpSeen.Load())
+		if s.IdleTimeout > 0 && time.Since(seen) > s.IdleTimeout {
+			// the client has to say hello again, possibly from a new address
+			c.log.Info("udp timed out")
+			c.udpAddr.Store(nil)
+			continue
+		}
+		if err := c.link.Send(protocol.Fast, protocol.HandlerPing, protocol.PingPayload()); err != nil {
+			c.log.Debug("ping failed", "channel", protocol.Fast, "err", err)
+		}
+	}
+}
+
+// handleControl answers the reserved messages of the heartbeat. It reports
+// whether the message was one of them.
+func (s *Server) handleControl(c *conn, handlerId uint32, data []byte, udp bool) bool {
+	switch handlerId {
+	case protocol.HandlerPing:
+		ch := protocol.Safe
+		if udp {
+			ch = protocol.Fast
+		}
+		if err := s.send(c, ch, protocol.HandlerPong, data); err != nil {
+			c.log.Debug("pong failed", "channel", ch, "err", err)
+		}
+		return true
+	case protocol.HandlerPong:
+		if rtt, ok := protocol.PongRTT(data); ok {
+			c.link.Meter().AddRTTSample(rtt)
+		}
+		return true
+	}
+	return false
+}
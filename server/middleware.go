@@ -0,0 +1,32 @@
+package server
+
+// Middleware wraps a handler, to run code around it or to not call it at
+// all.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware that wraps every handler. Like Register it has to be
+// called before the server starts.
+//
+// Middleware added with Use runs before the one added with UseFor, and
+// within each scope in the order it was added: the first middleware is the
+// outermost.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// UseFor adds middleware that only wraps the handler of handlerId.
+func (s *Server) UseFor(handlerId uint32, mw ...Middleware) {
+	s.handlerMiddleware[handlerId] = append(s.handlerMiddleware[handlerId], mw...)
+}
+
+// wrap puts the middleware for handlerId around h.
+func (s *Server) wrap(handlerId uint32, h Handler) Handler {
+	scoped := s.handlerMiddleware[handlerId]
+	for i := len(scoped) - 1; i >= 0; i-- {
+		h = scoped[i](h)
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"flera/protocol"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound = errors.New("room not found")
+)
+
+// RoomEvent is called when a connection joins or leaves a room.
+type RoomEvent func(s *Server, room string, connId uint32)
+
+type room struct {
+	// members are kept by id as a suspended connection stays in its rooms
+	members map[uint32]struct{}
+}
+
+// CreateRoom creates an empty room.
+func (s *Server) CreateRoom(name string) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	if _, ok := s.rooms[name]; ok {
+		return fmt.Errorf("%w: %s", ErrRoomExists, name)
+	}
+
+	s.rooms[name] = &room{members: make(map[uint32]struct{})}
+	return nil
+}
+
+// DeleteRoom removes a room, everyone still in it leaves.
+func (s *Server) DeleteRoom(name string) error {
+	s.roomsMu.Lock()
+	r, ok := s.rooms[name]
+	if !ok {
+		s.roomsMu.Unlock()
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+	delete(s.rooms, name)
+	s.roomsMu.Unlock()
+
+	for connId := range r.members {
+		s.roomEvent(s.OnRoomLeave, name, connId)
+	}
+	return nil
+}
+
+// JoinRoom puts a connection in a room. Joining a room twice does nothing.
+func (s *Server) JoinRoom(name string, connId uint32) error {
+	s.roomsMu.Lock()
+	r, ok := s.rooms[name]
+	if !ok {
+		s.roomsMu.Unlock()
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+
+	// looked up while holding roomsMu so a disconnecting conn is either
+	// not found or still removed by leaveRooms
+	if _, err := s.getConn(connId); err != nil {
+		s.roomsMu.Unlock()
+		return err
+	}
+
+	if _, ok := r.members[connId]; ok {
+		s.roomsMu.Unlock()
+		return nil
+	}
+	r.members[connId] = struct{}{}
+	s.roomsMu.Unlock()
+
+	s.roomEvent(s.OnRoomJoin, name, connId)
+	return nil
+}
+
+// LeaveRoom takes a connection out of a room.
+func (s *Server) LeaveRoom(name string, connId uint32) error {
+	s.roomsMu.Lock()
+	r, ok := s.rooms[name]
+	if !ok {
+		s.roomsMu.Unlock()
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+
+	if _, ok := r.members[connId]; !ok {
+		s.roomsMu.Unlock()
+		return fmt.Errorf("conn %d is not in room %s", connId, name)
+	}
+	delete(r.members, connId)
+	s.roomsMu.Unlock()
+
+	s.roomEvent(s.OnRoomLeave, name, connId)
+	return nil
+}
+
+// Rooms lists the names of all rooms, sorted.
+func (s *Server) Rooms() []string {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// RoomMembers lists the connections in a room, sorted.
+func (s *Server) RoomMembers(name string) ([]uint32, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	r, ok := s.rooms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+
+	connIds := make([]uint32, 0, len(r.members))
+	for connId := range r.members {
+		connIds = append(connIds, connId)
+	}
+	slices.Sort(connIds)
+	return connIds, nil
+}
+
+// ConnRooms lists the rooms a connection is in, sorted.
+func (s *Server) ConnRooms(connId uint32) []string {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	var names []string
+	for name, r := range s.rooms {
+		if _, ok := r.members[connId]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *Server) BroadcastToRoomSafe(name string, handlerId uint32, data []byte) error {
+	return s.BroadcastToRoom(name, protocol.Safe, handlerId, data)
+}
+
+func (s *Server) BroadcastToRoomFast(name string, handlerId uint32, data []byte) error {
+	return s.BroadcastToRoom(name, protocol.Fast, handlerId, data)
+}
+
+// BroadcastToRoom sends data to handlerId of everyone in a room over the
+// given channel.
+func (s *Server) BroadcastToRoom(name string, ch protocol.Channel, handlerId uint32, data []byte) error {
+	s.roomsMu.RLock()
+	r, ok := s.rooms[name]
+	if !ok {
+		s.roomsMu.RUnlock()
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+	members := make([]uint32, 0, len(r.members))
+	for connId := range r.members {
+		members = append(members, connId)
+	}
+	s.roomsMu.RUnlock()
+
+	var errs []error
+	for _, connId := range members {
+		c, err := s.getConn(connId)
+		if err != nil {
+			// suspended, waiting to be resumed
+			continue
+		}
+		if !reachable(c, ch) {
+			continue
+		}
+		if err := s.send(c, ch, handlerId, data); err != nil {
+			errs = append(errs, fmt.Errorf("conn %d: %w", c.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// leaveRooms takes a lost connection out of every room it was in.
+func (s *Server) leaveRooms(connId uint32) {
+	var left []string
+	s.roomsMu.Lock()
+	for name, r := range s.rooms {
+		if _, ok := r.members[connId]; ok {
+			delete(r.members, connId)
+			left = append(left, name)
+		}
+	}
+	s.roomsMu.Unlock()
+
+	slices.Sort(left)
+	for _, name := range left {
+		s.roomEvent(s.OnRoomLeave, name, connId)
+	}
+}
+
+func (s *Server) roomEvent(event RoomEvent, name string, connId uint32) {
+	if event != nil {
+		event(s, name, connId)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"flera/protocol"
+	"fmt"
+)
+
+// SendToClient sends data to handlerId of one client over the given channel.
+func (s *Server) SendToClient(connId uint32, ch protocol.Channel, handlerId uint32, data []byte) error {
+	c, err := s.getConn(connId)
+	if err != nil {
+		return err
+	}
+
+	return s.send(c, ch, handlerId, data)
+}
+
+func (s *Server) SendToClients(connIds []uint32, ch protocol.Channel, handlerId uint32, data []byte) error {
+	var errs []error
+	for _, connId := range connIds {
+		if err := s.SendToClient(connId, ch, handlerId, data); err != nil {
+			errs = append(errs, fmt.Errorf("conn %d: %w", connId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) Broadcast(ch protocol.Channel, handlerId uint32, data []byte) error {
+	var errs []error
+	s.rangeConns(func(c *conn) bool {
+		if !reachable(c, ch) {
+			return true
+		}
+
+		if err := s.send(c, ch, handlerId, data); err != nil {
+			errs = append(errs, fmt.Errorf("conn %d: %w", c.id, err))
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// reachable reports if a broadcast on ch should go to c. Clients that have
+// not said hello yet can't be reached, reliable messages wait for them.
+func reachable(c *conn, ch protocol.Channel) bool {
+	return (ch != protocol.Fast && ch != protocol.Sequenced) || c.udpAddr.Load() != nil
+}
+
+func (s *Server) send(c *conn, ch protocol.Channel, handlerId uint32, data []byte) error {
+	if ch == protocol.Safe {
+		return s.writeTcp(c, handlerId, data)
+	}
+	return c.link.Send(ch, handlerId, data)
+}
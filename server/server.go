@@ -1,69 +1,334 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flera/codec"
+	"flera/protocol"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrServerClosed = errors.New("server closed")
+
+// discard is the Logger of a new server.
+var discard = slog.New(slog.DiscardHandler)
+
+// handshakeTimeout bounds how long a new client may take to set up its
+// session before it is dropped.
+const handshakeTimeout = 10 * time.Second
+
+// closeTimeout bounds how long telling a client why it is disconnected may
+// take.
+const closeTimeout = time.Second
+
+// writeTimeout bounds how long a client may take to accept a frame before
+// it is considered gone.
+const writeTimeout = 5 * time.Second
+
 type Server struct {
-	tcpConns      sync.Map
-	udpAddrs      sync.Map
-	handlers      map[uint32]Handler
-	runId         uint32
-	tcpLn         *net.TCPListener
-	udpConn       *net.UDPConn
-	OnConn        Event
-	OnDisConn     Event
+	conns    sync.Map
+	handlers map[uint32]handler
+	// middleware wraps every handler, handlerMiddleware only the handler
+	// of one id
+	middleware        []Middleware
+	handlerMiddleware map[uint32][]Middleware
+	runId             atomic.Uint32
+	// seats is how many connections count against MaxConnections
+	seats   atomic.Int64
+	tcpLn   *net.TCPListener
+	udpConn *net.UDPConn
+	udpBufs sync.Pool
+	OnConn  Event
+	// OnDisConn is called once a connection is gone for good, with the
+	// reason it ended.
+	OnDisConn DisconnectEvent
+	// ResumeGrace is how long the session of a lost connection is kept for
+	// its client to come back and resume it with the same connId, rooms
+	// included. OnDisConn is only fired once it ran out. 0, the default,
+	// ends sessions right away.
+	ResumeGrace time.Duration
+	// OnSuspend is called when a connection is lost and its session starts
+	// waiting ResumeGrace for the client, OnResume when the client came
+	// back. A resumed connection doesn't fire OnConn.
+	OnSuspend Event
+	OnResume  Event
+	// OnRoomJoin and OnRoomLeave are called when a connection joins or
+	// leaves a room, leaving includes disconnecting and deleted rooms.
+	OnRoomJoin  RoomEvent
+	OnRoomLeave RoomEvent
+	// UdpPacketSize is the largest payload put in a single datagram, bigger
+	// fast messages are split into fragments. It has to match the client.
+	// Once the path MTU is discovered the packet size of the connection is
+	// set from it instead.
 	UdpPacketSize uint32
+	// MaxMessageSize caps the size of a single message. A client announcing
+	// a bigger safe (tcp) message is disconnected, bigger fast ones are
+	// dropped.
+	MaxMessageSize uint32
+	// TLSConfig turns on encryption. The safe channel runs over tls and
+	// the fast channel is encrypted with keys exported from it.
+	TLSConfig *tls.Config
+	// OnError is called when a handler returned an error or panicked, the
+	// error of a panic is a *protocol.PanicError. Errors of call handlers
+	// are sent back to the caller instead, only their panics end up here.
+	OnError ErrorHandler
+	// ErrorPolicy decides what happens to the client after OnError,
+	// logging the error by default.
+	ErrorPolicy protocol.ErrorPolicy
+	// MaxConnections caps how many clients can be connected at once,
+	// suspended sessions included. More are turned away, 0 lets everyone
+	// in.
+	MaxConnections int
+	// OnAccept is called when a client connects, before it gets an id, and
+	// can turn it away. It is also called for clients resuming a session.
+	OnAccept AcceptHook
+	// Authenticate checks the credentials of a connecting client before it
+	// gets an id, nil lets everyone in. The identity it returns is available
+	// through Identity.
+	Authenticate Authenticator
+	// Bans keeps the bans checked when a client connects, in memory by
+	// default.
+	Bans BanStore
+	// Logger receives what happens on the server, nothing is logged by
+	// default or when it is nil.
+	Logger *slog.Logger
+	// Codec encodes the messages of the typed helpers like Handle and Send,
+	// it must match the clients. JSON by default.
+	Codec codec.Codec
+	// HeartbeatInterval is how often clients are pinged, 0 turns pings off.
+	HeartbeatInterval time.Duration
+	// IdleTimeout is how long a client can stay silent before it is
+	// disconnected, 0 waits forever.
+	IdleTimeout time.Duration
+
+	rooms   map[string]*room
+	roomsMu sync.RWMutex
+
+	// sessions waiting to be resumed, by resume token
+	sessions   map[string]*session
+	sessionsMu sync.Mutex
+
+	// lifecycle
+	mu       sync.Mutex
+	closing  atomic.Bool
+	wg       sync.WaitGroup
+	shutdown chan struct{}
+	// closeCtx is cancelled once the server starts shutting down
+	closeCtx    context.Context
+	cancelClose context.CancelFunc
 }
 
+// Handler handles one message from a client. data is only valid until the
+// handler returns, as its memory is reused for later messages; copy it to
+// keep it around.
 type Handler func(s *Server, connId uint32, data []byte) error
 type Event func(s *Server, connId uint32)
+type DisconnectEvent func(s *Server, connId uint32, reason protocol.DisconnectReason)
 
-func (s *Server) Register(handlerId uint32, handler Handler) {
-	s.handlers[handlerId] = handler
+// Start listens on port and serves clients until ctx is cancelled or
+// Shutdown is called. It is the same as calling Listen followed by Serve.
+func (s *Server) Start(ctx context.Context, port string) error {
+	if err := s.Listen(port); err != nil {
+		return err
+	}
+	return s.Serve(ctx)
 }
 
-func (s *Server) Start(port string) error {
-	// setup udp
-	udpAddr, err := net.ResolveUDPAddr("udp", port)
-	if err != nil {
-		return err
+// Listen binds both the tcp and the udp socket to addr. Both protocols
+// always share the same port, if addr asks for port 0 a port that is free
+// for both is picked. The bound address is available through Addr.
+func (s *Server) Listen(addr string) error {
+	if s.tcpLn != nil {
+		return errors.New("server is already listening")
 	}
 
-	s.udpConn, err = net.ListenUDP("udp", udpAddr)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return err
 	}
-	go s.serveUDP()
 
-	// setup tcp
-	tcpAddr, err := net.ResolveTCPAddr("tcp", port)
-	if err != nil {
-		return err
+	attempts := 0
+	for {
+		// setup tcp
+		tcpLn, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return err
+		}
+
+		// setup udp on the port tcp got
+		bound := tcpLn.Addr().(*net.TCPAddr)
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: bound.Port, Zone: tcpAddr.Zone})
+		if err != nil {
+			tcpLn.Close()
+			// the port picked for tcp might be taken for udp, try another one
+			if tcpAddr.Port == 0 && attempts < 10 {
+				attempts++
+				continue
+			}
+			return err
+		}
+
+		if err := protocol.SetDontFragment(udpConn); err != nil {
+			s.logger().Warn("can't stop udp fragmentation, the mtu found may be too big", "err", err)
+		}
+
+		s.tcpLn = tcpLn
+		s.udpConn = udpConn
+		return nil
 	}
+}
 
-	s.tcpLn, err = net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return err
+// Addr returns the address the server is bound to, or nil before Listen.
+// The tcp and udp sockets share it.
+func (s *Server) Addr() net.Addr {
+	if s.tcpLn == nil {
+		return nil
+	}
+	return s.tcpLn.Addr()
+}
+
+// Serve serves clients on the sockets bound by Listen until ctx is
+// cancelled or Shutdown is called. It always returns a non-nil error; after
+// a shutdown the error is ErrServerClosed and all connections have been
+// drained.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.tcpLn == nil || s.udpConn == nil {
+		return errors.New("server is not listening, call Listen first")
+	}
+
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go s.serveUDP()
+
+	shutdownErr := make(chan error, 1)
+	stop := context.AfterFunc(ctx, func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	})
+
+	err := s.accept()
+	if !stop() {
+		// the shutdown was triggered by ctx, wait for it to finish draining
+		<-shutdownErr
 	}
+	return err
+}
 
+func (s *Server) accept() error {
 	for {
-		conn, err := s.tcpLn.AcceptTCP()
+		tcpConn, err := s.tcpLn.AcceptTCP()
 		if err != nil {
-			fmt.Println("Error accepting client")
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			s.logger().Warn("accept failed", "err", err)
+			continue
+		}
+		if s.refuseBanned(tcpConn) {
 			continue
 		}
 
-		go s.handleTcpConn(s.runId, conn)
-		s.runId++
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			tcpConn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handleTcpConn(tcpConn)
+	}
+}
+
+// Shutdown stops accepting new clients, stops reading from the existing
+// ones and waits for in-flight handlers to finish before closing every
+// connection, firing OnDisConn for each of them and for every session
+// waiting to be resumed. If ctx expires first the
+// remaining connections are closed forcefully and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		<-s.shutdown
+		return nil
+	}
+	s.closing.Store(true)
+	s.mu.Unlock()
+	defer close(s.shutdown)
+	s.cancelClose()
+
+	if s.tcpLn != nil {
+		s.tcpLn.Close()
+	}
+
+	// Unblock all readers without closing the sockets so that handlers
+	// still running can send their last messages.
+	now := time.Now()
+	if s.udpConn != nil {
+		s.udpConn.SetReadDeadline(now)
+	}
+	s.rangeConns(func(c *conn) bool {
+		c.tcp.SetReadDeadline(now)
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		s.expireSessions()
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.rangeConns(func(c *conn) bool {
+			c.tcp.Close()
+			return true
+		})
+		go s.expireSessions()
+	}
+
+	if s.udpConn != nil {
+		s.udpConn.Close()
 	}
+	return err
 }
 
 func New() *Server {
 	s := new(Server)
-	s.handlers = make(map[uint32]Handler)
-	s.UdpPacketSize = 1024
+	s.handlers = make(map[uint32]handler)
+	s.handlerMiddleware = make(map[uint32][]Middleware)
+	s.rooms = make(map[string]*room)
+	s.sessions = make(map[string]*session)
+	s.Bans = NewMemoryBanStore()
+	s.UdpPacketSize = protocol.DefaultPacketSize
+	s.MaxMessageSize = protocol.DefaultMaxMessageSize
+	s.HeartbeatInterval = protocol.DefaultHeartbeatInterval
+	s.IdleTimeout = protocol.DefaultIdleTimeout
+	s.Codec = codec.JSON
+	s.Logger = discard
+	s.shutdown = make(chan struct{})
+	s.closeCtx, s.cancelClose = context.WithCancel(context.Background())
 	return s
 }
+
+// logger returns Logger, or one that drops everything when it is nil.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return discard
+	}
+	return s.Logger
+}
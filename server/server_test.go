@@ -0,0 +1,75 @@
+package server_test
+
+import (
+	"context"
+	"flera/client"
+	"flera/protocol"
+	"flera/server"
+	"testing"
+	"time"
+)
+
+// startServer serves a new server on a free local port until the test ends.
+func startServer(t *testing.T, setup func(s *server.Server)) (*server.Server, string) {
+	t.Helper()
+	s := server.New()
+	if setup != nil {
+		setup(s)
+	}
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-errc
+	})
+	return s, s.Addr().String()
+}
+
+// connect connects a new client to addr, it is closed when the test ends.
+func connect(t *testing.T, addr string, setup func(c *client.Client)) *client.Client {
+	t.Helper()
+	c := client.New()
+	if setup != nil {
+		setup(c)
+	}
+	if err := c.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// A nil Logger logs nothing rather than panicking.
+func TestNilLogger(t *testing.T) {
+	got := make(chan struct{})
+	_, addr := startServer(t, func(s *server.Server) {
+		s.Logger = nil
+		s.Register(1, func(s *server.Server, connId uint32, data []byte) error {
+			close(got)
+			return nil
+		})
+	})
+	c := connect(t, addr, func(c *client.Client) {
+		c.Logger = nil
+	})
+
+	if err := c.Send(protocol.Safe, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler never ran")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
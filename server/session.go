@@ -0,0 +1,137 @@
+package server
+
+import (
+	"flera/protocol"
+	"log/slog"
+	"time"
+)
+
+// session is a lost connection waiting ResumeGrace for its client to come
+// back with the resume token.
+type session struct {
+	connId   uint32
+	identity string
+	log      *slog.Logger
+	// reason is why the connection was lost
+	reason protocol.DisconnectReason
+	// ready is closed once the old connection is torn down
+	ready chan struct{}
+	// dropped is why the session was ended before it was ready, the
+	// teardown ends it then
+	dropped *protocol.DisconnectReason
+	timer   *time.Timer
+}
+
+// suspend keeps the session of c for ResumeGrace, the session can't be
+// resumed before ready is closed.
+func (s *Server) suspend(c *conn, reason protocol.DisconnectReason) *session {
+	sess := &session{connId: c.id, identity: c.identity, log: c.log, reason: reason, ready: make(chan struct{})}
+	token := string(c.token)
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.sessions[token] = sess
+	sess.timer = time.AfterFunc(s.ResumeGrace, func() { s.expire(token, sess) })
+	return sess
+}
+
+// resume takes over the session of token, once its old connection is torn
+// down. It returns nil if there is no such session or it belongs to another
+// identity.
+func (s *Server) resume(token []byte, identity string) *session {
+	s.sessionsMu.Lock()
+	sess, ok := s.sessions[string(token)]
+	ok = ok && sess.identity == identity
+	if ok {
+		delete(s.sessions, string(token))
+		sess.timer.Stop()
+	}
+	s.sessionsMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	<-sess.ready
+	return sess
+}
+
+// expire ends a session whose client did not come back in time.
+func (s *Server) expire(token string, sess *session) {
+	s.sessionsMu.Lock()
+	if s.sessions[token] != sess {
+		// resumed in the meantime
+		s.sessionsMu.Unlock()
+		return
+	}
+	delete(s.sessions, token)
+	s.sessionsMu.Unlock()
+
+	<-sess.ready
+	s.end(sess.connId, sess.log, sess.reason)
+}
+
+// endSession ends the suspended session of connId right away, it reports
+// whether there was one.
+func (s *Server) endSession(connId uint32, reason protocol.DisconnectReason) bool {
+	s.sessionsMu.Lock()
+	var sess *session
+	for token, candidate := range s.sessions {
+		if candidate.connId == connId {
+			sess = candidate
+			delete(s.sessions, token)
+			break
+		}
+	}
+	if sess == nil {
+		s.sessionsMu.Unlock()
+		return false
+	}
+
+	sess.timer.Stop()
+	select {
+	case <-sess.ready:
+	default:
+		sess.dropped = &reason
+		s.sessionsMu.Unlock()
+		return true
+	}
+	s.sessionsMu.Unlock()
+
+	s.end(sess.connId, sess.log, reason)
+	return true
+}
+
+// ready marks sess as torn down, unless it was dropped in the meantime.
+func (s *Server) ready(sess *session) *protocol.DisconnectReason {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if sess.dropped == nil {
+		close(sess.ready)
+	}
+	return sess.dropped
+}
+
+// expireSessions ends every session still waiting for its client.
+func (s *Server) expireSessions() {
+	s.sessionsMu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*session)
+	s.sessionsMu.Unlock()
+
+	for _, sess := range sessions {
+		sess.timer.Stop()
+		<-sess.ready
+		s.end(sess.connId, sess.log, protocol.DisconnectReason{Code: protocol.ServerShutdown})
+	}
+}
+
+// end removes what is left of a connection that is gone for good and fires
+// OnDisConn.
+func (s *Server) end(connId uint32, log *slog.Logger, reason protocol.DisconnectReason) {
+	s.seats.Add(-1)
+	s.leaveRooms(connId)
+	log.Info("disconnected", "reason", reason)
+	if s.OnDisConn != nil {
+		s.OnDisConn(s, connId, reason)
+	}
+}
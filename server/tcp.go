@@ -1,153 +1,325 @@
 package server
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"errors"
+	"flera/protocol"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"time"
 )
 
 func (s *Server) SendToClientSafe(connId, handlerId uint32, data []byte) error {
-	return s.sendTcp(connId, handlerId, data)
+	return s.SendToClient(connId, protocol.Safe, handlerId, data)
 }
 
 func (s *Server) SendToClientsSafe(connIds []uint32, handlerId uint32, data []byte) error {
-	var errs []error
-	for _, connId := range connIds {
-		if err := s.sendTcp(connId, handlerId, data); err != nil {
-			errs = append(errs, fmt.Errorf("conn %d: %w", connId, err))
-		}
-	}
-	return errors.Join(errs...)
+	return s.SendToClients(connIds, protocol.Safe, handlerId, data)
 }
 
 func (s *Server) BroadcastSafe(handlerId uint32, data []byte) error {
-	var errs []error
-	s.tcpConns.Range(func(key, value any) bool {
-		connId, ok := key.(uint32)
-		if !ok {
-			errs = append(errs, fmt.Errorf("invalid connection id: %v", key))
-			return true
-		}
-
-		if err := s.sendTcp(connId, handlerId, data); err != nil {
-			errs = append(errs, fmt.Errorf("conn %d: %w", connId, err))
-		}
-		return true
-	})
-	return errors.Join(errs...)
+	return s.Broadcast(protocol.Safe, handlerId, data)
 }
 
-func (s *Server) sendTcp(connId, callId uint32, data []byte) error {
-	// fmt.Printf("Trying to send message to %d with tcp\n", connId)
-
-	conn, err := s.getTcpConn(connId)
-	if err != nil {
-		return err
-	}
-
-	callBuf := new(bytes.Buffer)
-	if err := binary.Write(callBuf, binary.BigEndian, uint32(callId)); err != nil {
-		return err
-	}
-
-	sizeBuf := new(bytes.Buffer)
-	if err := binary.Write(sizeBuf, binary.BigEndian, uint32(len(data))); err != nil {
-		return err
-	}
+func (s *Server) writeTcp(c *conn, callId uint32, data []byte) error {
+	return s.writeTcpBy(c, callId, data, time.Now().Add(writeTimeout))
+}
 
-	packet := append(append(callBuf.Bytes(), sizeBuf.Bytes()...), data...)
-	if _, err := conn.Write(packet); err != nil {
+// writeTcpBy writes a frame to c, giving up at deadline. A client that
+// doesn't take a frame in time has stopped reading, half a frame may be on
+// the wire, so the connection is closed.
+func (s *Server) writeTcpBy(c *conn, callId uint32, data []byte, deadline time.Time) error {
+	c.tcp.SetWriteDeadline(deadline)
+	if err := protocol.WriteFrame(c.tcp, callId, data, s.MaxMessageSize); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.log.Debug("write timed out, closing", "handlerId", callId)
+			c.tcp.Close()
+		}
 		return err
 	}
-
-	// fmt.Printf("Message sent to %d with tcp\n", connId)
+	c.link.Meter().SentSafe(protocol.FrameHeaderSize + len(data))
 	return nil
 }
 
-func (s *Server) getTcpConn(connId uint32) (*net.TCPConn, error) {
-	val, ok := s.tcpConns.Load(connId)
-	if !ok {
-		return nil, fmt.Errorf("Could not find %d in the connMap", connId)
-	}
+func (s *Server) handleTcpConn(tcpConn net.Conn) {
+	defer s.wg.Done()
 
-	conn, ok := val.(*net.TCPConn)
-	if !ok {
-		return nil, fmt.Errorf("Could convert conn map output to TCPConn")
+	c, welcome, err := s.newConn(tcpConn)
+	if err != nil {
+		if !errors.Is(err, errRejected) {
+			s.logger().Warn("handshake failed", "addr", tcpConn.RemoteAddr(), "err", err)
+		}
+		tcpConn.Close()
+		return
 	}
+	tcpConn = c.tcp
+	connId := c.id
 
-	return conn, nil
-}
-
-func (s *Server) handleTcpConn(connId uint32, conn *net.TCPConn) {
 	// store client
-	s.tcpConns.Store(connId, conn)
+	s.conns.Store(connId, c)
+
+	c.inflight.Add(3)
+	go s.work(c)
+	go s.heartbeat(c)
+	go func() {
+		defer c.inflight.Done()
+		c.link.Run(c.closed)
+	}()
 
+	// why the read loop ended, unless the connection was closed on purpose
+	reason := protocol.DisconnectReason{Code: protocol.ConnectionLost}
+	// announced is set once OnConn or OnResume fired. A resumed session is
+	// known to the application even before that, from its old connection
+	announced := false
 	defer func() {
-		s.tcpConns.Delete(connId)
-		// s.udpAddrs.Delete(connId)
-		fmt.Printf("Conn %d lost via tcp\n", connId)
-		if s.OnDisConn != nil {
-			s.OnDisConn(s, connId)
+		known := announced || welcome.Resumed
+		reason, first := c.stop(reason)
+
+		// a client that lost its connection may come back for its session
+		var sess *session
+		if known && s.ResumeGrace > 0 && !s.closing.Load() && reason.Retry() {
+			sess = s.suspend(c, reason)
+		}
+
+		// no more replies can arrive
+		c.calls.Abort()
+		// a peer that is gone won't take what is still being written to it
+		if reason.Code == protocol.ConnectionLost || reason.Code == protocol.TimedOut {
+			tcpConn.SetWriteDeadline(time.Now())
+		}
+		// let the handlers finish what was already received
+		close(c.closed)
+		c.inflight.Wait()
+		if first {
+			s.sendClose(c, reason)
+		}
+		tcpConn.Close()
+		// a resumed connection may already have taken the id over
+		s.conns.CompareAndDelete(connId, c)
+
+		if !known {
+			// it never got further than the handshake, only its seat is
+			// taken
+			s.seats.Add(-1)
+			c.log.Info("dropped before connecting", "reason", reason)
+			return
+		}
+		if sess == nil {
+			s.end(connId, c.log, reason)
+			return
+		}
+		c.log.Info("suspended", "grace", s.ResumeGrace, "reason", reason)
+		// the session didn't come back as far as the application knows
+		if announced && s.OnSuspend != nil {
+			s.OnSuspend(s, connId)
+		}
+		if dropped := s.ready(sess); dropped != nil {
+			s.end(connId, c.log, *dropped)
 		}
 	}()
 
-	fmt.Printf("Conn %d connected\n", connId)
-	// send id
-	idBuf := new(bytes.Buffer)
-	if err := binary.Write(idBuf, binary.BigEndian, connId); err != nil {
-		fmt.Println(err)
-		return
+	if welcome.Resumed {
+		c.log.Info("resumed")
+	} else {
+		c.log.Info("connected")
 	}
-
-	if _, err := conn.Write(idBuf.Bytes()); err != nil {
-		fmt.Println(err)
+	// send id and the secret the client signs its udp packets with
+	if err := s.writeTcp(c, protocol.HandlerWelcome, welcome.Marshal()); err != nil {
+		c.log.Warn("sending welcome failed", "err", err)
 		return
 	}
 
 	// send on conn event
-	if s.OnConn != nil {
+	announced = true
+	if welcome.Resumed {
+		if s.OnResume != nil {
+			s.OnResume(s, connId)
+		}
+	} else if s.OnConn != nil {
 		s.OnConn(s, connId)
 	}
 
+	// the server might have started shutting down before the conn was stored
+	if s.closing.Load() {
+		reason = protocol.DisconnectReason{Code: protocol.ServerShutdown}
+		return
+	}
+
 	// listen for messages
-	info := make([]byte, 8)
 	for {
-		// First read the info part of the packet
-		if _, err := conn.Read(info); err != nil {
-			fmt.Println(err)
+		if s.IdleTimeout > 0 {
+			tcpConn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		// Shutdown might have set its deadline just before ours
+		if s.closing.Load() {
+			reason = protocol.DisconnectReason{Code: protocol.ServerShutdown}
 			return
 		}
 
-		var handlerId uint32
-		if err := binary.Read(bytes.NewReader(info[:4]), binary.BigEndian, &handlerId); err != nil {
-			fmt.Println(err)
-			continue
+		handlerId, data, err := protocol.ReadFrame(tcpConn, s.MaxMessageSize)
+		if err != nil {
+			reason = protocol.ReadReason(err)
+			if s.closing.Load() {
+				reason = protocol.DisconnectReason{Code: protocol.ServerShutdown}
+			} else if reason.Code == protocol.TimedOut {
+				c.log.Info("timed out")
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.log.Warn("read failed", "err", err)
+			}
+			return
 		}
 
-		var size uint32
-		if err := binary.Read(bytes.NewReader(info[4:]), binary.BigEndian, &size); err != nil {
-			fmt.Println(err)
+		c.link.Meter().ReceivedSafe(len(data))
+
+		if handlerId == protocol.HandlerClose {
+			// whatever the client claims, it left on purpose
+			var told protocol.DisconnectReason
+			if err := told.Unmarshal(data); err != nil {
+				reason = protocol.ReadReason(err)
+			} else {
+				reason = protocol.DisconnectReason{Code: protocol.ClientQuit, Message: told.Message}
+			}
+			c.log.Info("closed by client", "reason", reason)
+			return
+		}
+		if s.handleControl(c, handlerId, data, false) {
 			continue
 		}
 
-		// Read data
-		data := make([]byte, size)
-		if _, err := conn.Read(data); err != nil {
-			fmt.Println(err)
+		m, err := s.readCall(c, handlerId, data)
+		if err != nil {
+			c.log.Warn("bad call", "handlerId", handlerId, "err", err)
+			reason = protocol.ReadReason(err)
 			return
 		}
-
-		if handler, ok := s.handlers[handlerId]; ok {
-			go func() {
-				if err := handler(s, connId, data); err != nil {
-					fmt.Println(err)
-				}
-			}()
-		} else {
-			fmt.Printf("No handler with id %d\n", handlerId)
+		if m == nil {
 			continue
 		}
+		c.enqueue(*m)
+	}
+}
+
+// disconnect closes the connection on purpose, telling the client why.
+func (s *Server) disconnect(c *conn, reason protocol.DisconnectReason) {
+	if _, first := c.stop(reason); first {
+		s.sendClose(c, reason)
+		c.tcp.Close()
+	}
+}
+
+// sendClose tells the client why its connection ends, unless it knows.
+func (s *Server) sendClose(c *conn, reason protocol.DisconnectReason) {
+	switch reason.Code {
+	case protocol.ConnectionLost, protocol.ClientQuit:
+		return
+	}
+	if err := s.writeTcpBy(c, protocol.HandlerClose, reason.Marshal(), time.Now().Add(closeTimeout)); err != nil {
+		c.log.Debug("sending close failed", "err", err)
+	}
+}
+
+// newConn sets up the session of a new client: the tls handshake when the
+// server has a TLSConfig, the handshake of the client that may resume an
+// earlier session, and the link protecting its udp datagrams.
+func (s *Server) newConn(tcpConn net.Conn) (*conn, protocol.Welcome, error) {
+	var welcome protocol.Welcome
+	tcpConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	// the conn isn't stored yet, so Shutdown can't reach it on its own
+	raw := tcpConn
+	stop := context.AfterFunc(s.closeCtx, func() { raw.SetDeadline(time.Now()) })
+	defer stop()
+
+	var tlsState *tls.ConnectionState
+	if s.TLSConfig != nil {
+		tlsConn := tls.Server(tcpConn, s.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, welcome, err
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		tcpConn = tlsConn
+	}
+
+	handlerId, data, err := protocol.ReadFrame(tcpConn, s.MaxMessageSize)
+	if err != nil {
+		return nil, welcome, err
+	}
+	if handlerId != protocol.HandlerHandshake {
+		return nil, welcome, &protocol.ProtocolError{Err: fmt.Errorf("expected handshake, got handler %d", handlerId)}
+	}
+	var handshake protocol.Handshake
+	if err := handshake.Unmarshal(data); err != nil {
+		return nil, welcome, err
+	}
+	tcpConn.SetDeadline(time.Time{})
+
+	if err := s.admit(tcpConn); err != nil {
+		return nil, welcome, err
+	}
+	identity, err := s.authenticate(tcpConn, handshake.Credentials)
+	if err != nil {
+		return nil, welcome, err
+	}
+
+	if welcome.Secret, err = protocol.NewSecret(); err != nil {
+		return nil, welcome, err
+	}
+	if s.ResumeGrace > 0 {
+		if welcome.Token, err = protocol.NewToken(); err != nil {
+			return nil, welcome, err
+		}
+	}
+
+	if len(handshake.Token) > 0 {
+		if sess := s.resume(handshake.Token, identity); sess != nil {
+			welcome.ConnId = sess.connId
+			welcome.Resumed = true
+		}
+	}
+	if !welcome.Resumed {
+		if err := s.seat(tcpConn); err != nil {
+			return nil, welcome, err
+		}
+		welcome.ConnId = s.runId.Add(1) - 1
+	}
+	connId := welcome.ConnId
+
+	c := &conn{
+		id:        connId,
+		tcp:       tcpConn,
+		addr:      remoteAddr(tcpConn),
+		identity:  identity,
+		queue:     make(chan message, queueSize),
+		datagrams: make(chan message, queueSize),
+		closed:    make(chan struct{}),
+		log:       s.logger().With("connId", connId, "addr", tcpConn.RemoteAddr()),
+		token:     welcome.Token,
 	}
+	if identity != "" {
+		c.log = c.log.With("identity", identity)
+	}
+
+	if tlsState == nil {
+		c.link = protocol.NewLink(connId, welcome.Secret, true)
+	} else {
+		c.link, err = protocol.NewTLSLink(connId, *tlsState, true)
+		if err != nil {
+			if welcome.Resumed {
+				// the session is known to the application, it ends like
+				// any other
+				s.end(connId, c.log, protocol.DisconnectReason{Code: protocol.ConnectionLost})
+			} else {
+				s.seats.Add(-1)
+			}
+			return nil, welcome, err
+		}
+	}
+
+	c.link.SetWriter(func(packet []byte) error { return s.writeUdp(c, packet) })
+	c.link.SetPacketSize(int(s.UdpPacketSize))
+	c.link.SetMaxMessageSize(s.MaxMessageSize)
+	return c, welcome, nil
 }
@@ -0,0 +1,172 @@
+package server_test
+
+import (
+	"context"
+	"flera/client"
+	"flera/protocol"
+	"flera/server"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A client that stops reading while a handler writes to it must still time
+// out, rather than hang the teardown behind the blocked write.
+func TestTimeoutWhileWriting(t *testing.T) {
+	disconnected := make(chan protocol.DisconnectReason, 1)
+	_, addr := startServer(t, func(s *server.Server) {
+		s.IdleTimeout = time.Second
+		s.HeartbeatInterval = 100 * time.Millisecond
+		s.Register(1, func(s *server.Server, connId uint32, data []byte) error {
+			// fills the socket buffers of a client that doesn't read
+			chunk := make([]byte, 64<<10)
+			for {
+				if err := s.SendToClientSafe(connId, 2, chunk); err != nil {
+					return err
+				}
+			}
+		})
+		s.OnDisConn = func(s *server.Server, connId uint32, reason protocol.DisconnectReason) {
+			disconnected <- reason
+		}
+	})
+
+	tcpConn := dialRaw(t, addr)
+	if err := protocol.WriteFrame(tcpConn, 1, nil, protocol.DefaultMaxMessageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reason := <-disconnected:
+		if reason.Code != protocol.TimedOut {
+			t.Errorf("disconnected with %v, want %v", reason, protocol.TimedOut)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("the client never timed out")
+	}
+}
+
+// A client closing the connection quits, even when it claims otherwise.
+func TestCloseFromClientIsQuit(t *testing.T) {
+	for _, code := range []protocol.DisconnectCode{protocol.Banned, protocol.TimedOut, protocol.ServerShutdown} {
+		t.Run(code.String(), func(t *testing.T) {
+			disconnected := make(chan protocol.DisconnectReason, 1)
+			_, addr := startServer(t, func(s *server.Server) {
+				s.ResumeGrace = time.Minute
+				s.OnSuspend = func(s *server.Server, connId uint32) {
+					t.Error("session of a client that quit was suspended")
+				}
+				s.OnDisConn = func(s *server.Server, connId uint32, reason protocol.DisconnectReason) {
+					disconnected <- reason
+				}
+			})
+
+			tcpConn := dialRaw(t, addr)
+			reason := protocol.DisconnectReason{Code: code, Message: "x"}
+			if err := protocol.WriteFrame(tcpConn, protocol.HandlerClose, reason.Marshal(), protocol.DefaultMaxMessageSize); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case reason := <-disconnected:
+				want := protocol.DisconnectReason{Code: protocol.ClientQuit, Message: "x"}
+				if reason != want {
+					t.Errorf("disconnected with %v, want %v", reason, want)
+				}
+			case <-time.After(4 * time.Second):
+				t.Fatal("the client never disconnected")
+			}
+		})
+	}
+}
+
+// dialRaw connects to addr and does the handshake by hand, the connection
+// is closed when the test ends.
+func dialRaw(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpConn.Close() })
+	if err := protocol.WriteFrame(tcpConn, protocol.HandlerHandshake, protocol.Handshake{}.Marshal(), protocol.DefaultMaxMessageSize); err != nil {
+		t.Fatal(err)
+	}
+	if handlerId, _, err := protocol.ReadFrame(tcpConn, protocol.DefaultMaxMessageSize); err != nil || handlerId != protocol.HandlerWelcome {
+		t.Fatalf("expected welcome, got handler %d: %v", handlerId, err)
+	}
+	return tcpConn
+}
+
+// A client that connected but never said anything doesn't hold up a
+// shutdown until its handshake times out.
+func TestShutdownDuringHandshake(t *testing.T) {
+	s, addr := startServer(t, nil)
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	// give the server time to accept it
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+}
+
+// A client that is gone before it got its welcome leaves no trace: no
+// disconnect without a connect, and its seat is free again.
+func TestGoneBeforeWelcome(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[uint32]bool)
+	_, addr := startServer(t, func(s *server.Server) {
+		s.MaxConnections = 1
+		s.OnConn = func(s *server.Server, connId uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			conns[connId] = true
+		}
+		s.OnDisConn = func(s *server.Server, connId uint32, reason protocol.DisconnectReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !conns[connId] {
+				t.Errorf("conn %d disconnected without connecting", connId)
+			}
+			delete(conns, connId)
+		}
+	})
+
+	for range 20 {
+		tcpConn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.WriteFrame(tcpConn, protocol.HandlerHandshake, protocol.Handshake{}.Marshal(), protocol.DefaultMaxMessageSize); err != nil {
+			t.Fatal(err)
+		}
+		// reset the connection so the welcome can't be written
+		tcpConn.(*net.TCPConn).SetLinger(0)
+		tcpConn.Close()
+	}
+
+	// every seat comes back, so a real client still fits
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := client.New()
+		err := c.Connect(addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no seat came back: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
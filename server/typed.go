@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"flera/protocol"
+	"fmt"
+)
+
+// Handle registers a handler that gets messages decoded into T with the
+// Codec of the server.
+func Handle[T any](s *Server, handlerId uint32, h func(s *Server, connId uint32, msg T) error) {
+	s.Register(handlerId, func(s *Server, connId uint32, data []byte) error {
+		var msg T
+		if err := s.Codec.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("decode message for handler %d: %w", handlerId, err)
+		}
+		return h(s, connId, msg)
+	})
+}
+
+// HandleCall registers a call handler that gets calls decoded into T and
+// replies with R, both encoded with the Codec of the server.
+func HandleCall[T, R any](s *Server, handlerId uint32, h func(s *Server, connId uint32, msg T) (R, error)) {
+	s.RegisterCall(handlerId, func(s *Server, connId uint32, data []byte) ([]byte, error) {
+		var msg T
+		if err := s.Codec.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("decode call for handler %d: %w", handlerId, err)
+		}
+
+		reply, err := h(s, connId, msg)
+		if err != nil {
+			return nil, err
+		}
+		return s.Codec.Marshal(reply)
+	})
+}
+
+// Send encodes msg and sends it to handlerId of one client over the given
+// channel.
+func Send[T any](s *Server, connId uint32, ch protocol.Channel, handlerId uint32, msg T) error {
+	data, err := s.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.SendToClient(connId, ch, handlerId, data)
+}
+
+// Broadcast encodes msg and sends it to handlerId of every client over the
+// given channel.
+func Broadcast[T any](s *Server, ch protocol.Channel, handlerId uint32, msg T) error {
+	data, err := s.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.Broadcast(ch, handlerId, data)
+}
+
+// BroadcastToRoom encodes msg and sends it to handlerId of everyone in a
+// room over the given channel.
+func BroadcastToRoom[T any](s *Server, room string, ch protocol.Channel, handlerId uint32, msg T) error {
+	data, err := s.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.BroadcastToRoom(room, ch, handlerId, data)
+}
+
+// Call encodes msg, calls handlerId on a client and decodes its reply into
+// R.
+func Call[T, R any](ctx context.Context, s *Server, connId uint32, handlerId uint32, msg T) (R, error) {
+	var reply R
+	data, err := s.Codec.Marshal(msg)
+	if err != nil {
+		return reply, err
+	}
+
+	data, err = s.Call(ctx, connId, handlerId, data)
+	if err != nil {
+		return reply, err
+	}
+	err = s.Codec.Unmarshal(data, &reply)
+	return reply, err
+}
@@ -1,127 +1,139 @@
 package server
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
+	"flera/protocol"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 )
 
 func (s *Server) SendToClientFast(connId, handlerId uint32, data []byte) error {
-	return s.sendUdp(connId, handlerId, data)
+	return s.SendToClient(connId, protocol.Fast, handlerId, data)
 }
 
 func (s *Server) SendToClientsFast(connIds []uint32, handlerId uint32, data []byte) error {
-	var errs []error
-	for _, connId := range connIds {
-		if err := s.sendUdp(connId, handlerId, data); err != nil {
-			errs = append(errs, fmt.Errorf("conn %d: %w", connId, err))
-		}
-	}
-	return errors.Join(errs...)
+	return s.SendToClients(connIds, protocol.Fast, handlerId, data)
 }
 
 func (s *Server) BroadcastFast(handlerId uint32, data []byte) error {
-	var errs []error
-	s.udpAddrs.Range(func(key, value any) bool {
-		connId, ok := key.(uint32)
-		if !ok {
-			errs = append(errs, fmt.Errorf("invalid connection id: %v", key))
-			return true
-		}
-
-		if err := s.sendUdp(connId, handlerId, data); err != nil {
-			errs = append(errs, fmt.Errorf("conn %d: %w", connId, err))
-		}
-		return true
-	})
-	return errors.Join(errs...)
+	return s.Broadcast(protocol.Fast, handlerId, data)
 }
 
-func (s *Server) sendUdp(connId, callId uint32, data []byte) error {
-	// fmt.Printf("Trying to send message to %d with udp\n", connId)
-
-	addr, err := s.getUdpAddr(connId)
-	if err != nil {
-		return err
-	}
-
-	callBuf := new(bytes.Buffer)
-	if err := binary.Write(callBuf, binary.BigEndian, uint32(callId)); err != nil {
-		return err
+// writeUdp puts a datagram from the link of c on the wire.
+func (s *Server) writeUdp(c *conn, packet []byte) error {
+	addr := c.udpAddr.Load()
+	if addr == nil {
+		return fmt.Errorf("conn %d has no udp address yet", c.id)
 	}
 
-	packet := append(callBuf.Bytes(), data...)
-	if _, err := s.udpConn.WriteToUDP(packet, addr); err != nil {
+	if _, err := s.udpConn.WriteToUDPAddrPort(packet, *addr); err != nil {
 		return err
 	}
 
-	// fmt.Printf("Message sent to %d with udp\n", connId)
 	return nil
 }
 
-func (s *Server) getUdpAddr(connId uint32) (*net.UDPAddr, error) {
-	val, ok := s.udpAddrs.Load(connId)
-	if !ok {
-		return nil, fmt.Errorf("Could not find %d in the connMap", connId)
-	}
-
-	conn, ok := val.(*net.UDPAddr)
-	if !ok {
-		return nil, fmt.Errorf("Could convert conn map output to TCPConn")
-	}
-
-	return conn, nil
-}
-
 func (s *Server) serveUDP() {
-	defer s.udpConn.Close()
-	buf := make([]byte, s.UdpPacketSize+8)
-	fmt.Println(s.udpConn.LocalAddr())
-
-	defer func() {
-		s.udpAddrs.Clear()
-		fmt.Println("Conn lost via udp")
-	}()
+	defer s.wg.Done()
+	size := protocol.ReceiveBufferSize(s.UdpPacketSize)
+	s.udpBufs.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	s.logger().Info("serving udp", "addr", s.udpConn.LocalAddr())
 
-	// fmt.Printf("buf is %d big\n", len(buf))
 	for {
-		// fmt.Println("Udp serving")
-		n, addr, err := s.udpConn.ReadFromUDP(buf)
-		// fmt.Println("Got udp message")
+		// every datagram gets its own buffer, it goes back to the pool when
+		// the handler is done with it
+		buf := s.udpBufs.Get().(*[]byte)
+		n, addr, err := s.udpConn.ReadFromUDPAddrPort(*buf)
 		if err != nil {
-			fmt.Println(err)
+			s.udpBufs.Put(buf)
+			if s.closing.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger().Warn("udp read failed", "err", err)
 			continue
 		}
 
-		var connId uint32
-		if err := binary.Read(bytes.NewReader(buf[:4]), binary.BigEndian, &connId); err != nil {
-			fmt.Println(err)
+		c, d, err := s.openUdp((*buf)[:n], addr)
+		if err != nil {
+			// anything that does not come from a known client is dropped
+			s.logger().Debug("dropped datagram", "addr", addr, "err", err)
+			s.udpBufs.Put(buf)
 			continue
 		}
 
-		var handlerId uint32
-		if err := binary.Read(bytes.NewReader(buf[4:8]), binary.BigEndian, &handlerId); err != nil {
-			fmt.Println(err)
+		c.udpSeen.Store(time.Now().UnixNano())
+		if d.HandlerId == protocol.HandlerHello {
+			s.udpBufs.Put(buf)
 			continue
 		}
 
-		if handlerId == ^uint32(0) {
-			s.udpAddrs.Store(connId, addr)
-			fmt.Printf("Hello world stuff from %d\n", connId)
+		// a reliable datagram is acked once received, so it is only taken
+		// when its messages fit, otherwise the resend of the client waits
+		// for the handlers to catch up
+		reliable := d.Channel == protocol.Reliable || d.Channel == protocol.ReliableOrdered
+		if reliable && !c.room(c.link.Room(d)) {
+			c.log.Debug("falling behind, left datagram unacknowledged", "handlerId", d.HandlerId, "channel", d.Channel)
+			s.udpBufs.Put(buf)
 			continue
 		}
 
-		if handler, ok := s.handlers[handlerId]; ok {
-			go func() {
-				if err := handler(s, connId, buf[8:n]); err != nil {
-					fmt.Println(err)
-				}
-			}()
-		} else {
-			fmt.Printf("No handler found for function %d\n", handlerId)
+		// buf goes with the message that points into it, if any
+		inUse := false
+		for _, m := range c.link.Receive(d) {
+			if s.handleControl(c, m.HandlerId, m.Data, true) {
+				continue
+			}
+
+			msg := message{handlerId: m.HandlerId, data: m.Data}
+			if m.Borrowed {
+				msg.buf = buf
+				inUse = true
+			}
+			if !c.tryEnqueue(msg) {
+				c.log.Debug("falling behind, dropped message", "handlerId", m.HandlerId, "channel", d.Channel)
+				inUse = inUse && !m.Borrowed
+			}
+		}
+		if !inUse {
+			s.udpBufs.Put(buf)
 		}
+	}
+}
 
+// openUdp authenticates a datagram against the session of the conn it
+// claims to come from. A hello binds the conn to the address it was sent
+// from, after that datagrams from any other address are rejected.
+func (s *Server) openUdp(packet []byte, addr netip.AddrPort) (*conn, protocol.Datagram, error) {
+	connId, err := protocol.DatagramConnId(packet)
+	if err != nil {
+		return nil, protocol.Datagram{}, err
+	}
+
+	c, err := s.getConn(connId)
+	if err != nil {
+		return nil, protocol.Datagram{}, err
 	}
+
+	d, err := c.link.Open(packet)
+	if err != nil {
+		return nil, protocol.Datagram{}, err
+	}
+
+	if d.HandlerId == protocol.HandlerHello && c.udpAddr.CompareAndSwap(nil, &addr) {
+		c.log.Info("bound udp", "udpAddr", addr)
+		// the path may be new, so find out how much fits through it
+		c.link.DiscoverMTU(addr.Addr())
+		return c, d, nil
+	}
+
+	if bound := c.udpAddr.Load(); bound == nil || *bound != addr {
+		return nil, protocol.Datagram{}, fmt.Errorf("conn %d: datagram from unexpected address %s", connId, addr)
+	}
+
+	return c, d, nil
 }
@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"flera/protocol"
+	"flera/server"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Reliable messages wait for a slow handler instead of being dropped, and
+// while they wait the datagrams of other clients keep being read.
+func TestReliableMessagesReachSlowHandler(t *testing.T) {
+	// more than fit in the queue of a connection
+	const count = 500
+	const fast = 50
+
+	var mu sync.Mutex
+	var got []uint32
+	done := make(chan struct{})
+	release := make(chan struct{})
+	bound := make(chan struct{})
+	var fastGot atomic.Int32
+	_, addr := startServer(t, func(s *server.Server) {
+		s.Register(1, func(s *server.Server, connId uint32, data []byte) error {
+			<-release
+			// slow enough for the queue of the connection to fill up
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, binary.BigEndian.Uint32(data))
+			if len(got) == count {
+				close(done)
+			}
+			return nil
+		})
+		s.Register(2, func(s *server.Server, connId uint32, data []byte) error {
+			fastGot.Add(1)
+			return nil
+		})
+		s.Register(3, func(s *server.Server, connId uint32, data []byte) error {
+			close(bound)
+			return nil
+		})
+	})
+	c := connect(t, addr, nil)
+	other := connect(t, addr, nil)
+
+	// a reliable message only arrives once the udp address is bound
+	if err := other.Send(protocol.Reliable, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("udp never got bound")
+	}
+
+	for i := range uint32(count) {
+		data := binary.BigEndian.AppendUint32(nil, i)
+		for {
+			err := c.Send(protocol.ReliableOrdered, 1, data)
+			if errors.Is(err, protocol.ErrWindowFull) {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// the handler is still blocked, so the queue of c is full
+	for range fast {
+		if err := other.Send(protocol.Fast, 2, nil); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for fastGot.Load() < fast && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fastGot.Load(); n < fast*4/5 {
+		t.Errorf("other client got %d of %d fast messages through", n, fast)
+	}
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("handler got %d of %d messages", len(got), count)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, n := range got {
+		if n != uint32(i) {
+			t.Fatalf("message %d arrived as %d", i, n)
+		}
+	}
+}